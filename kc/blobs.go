@@ -0,0 +1,151 @@
+package kc
+
+import (
+	"encoding/binary"
+	"io"
+	"io/ioutil"
+)
+
+const (
+	// BlobChunkSize is the maximum size of each record a blob is split into.
+	BlobChunkSize = 1 << 16
+)
+
+func chunkKeys(keys [][]byte, chunk uint64) (result [][]byte) {
+	b := make([]byte, 8)
+	binary.BigEndian.PutUint64(b, chunk)
+	result = make([][]byte, len(keys)+1)
+	copy(result, keys)
+	result[len(keys)] = b
+	return
+}
+
+type blobReader struct {
+	db    *DB
+	keys  [][]byte
+	chunk uint64
+	buf   []byte
+}
+
+func (self *blobReader) Read(p []byte) (n int, err error) {
+	for len(self.buf) == 0 {
+		var b []byte
+		if b, err = self.db.Get(chunkKeys(self.keys, self.chunk)); err != nil {
+			if err.Error() == NoRecord && self.chunk > 0 {
+				err = io.EOF
+			}
+			return
+		}
+		self.chunk++
+		self.buf = b
+	}
+	n = copy(p, self.buf)
+	self.buf = self.buf[n:]
+	return
+}
+
+type blobWriter struct {
+	db      *DB
+	keys    [][]byte
+	chunk   uint64
+	buf     []byte
+	cleared bool
+}
+
+func (self *blobWriter) clear() (err error) {
+	if !self.cleared {
+		if err = self.db.ClearAll(self.keys); err != nil {
+			return
+		}
+		self.cleared = true
+	}
+	return
+}
+
+func (self *blobWriter) flush(size int) (err error) {
+	if err = self.db.Set(chunkKeys(self.keys, self.chunk), self.buf[:size]); err != nil {
+		return
+	}
+	self.chunk++
+	self.buf = self.buf[size:]
+	return
+}
+
+func (self *blobWriter) Write(p []byte) (n int, err error) {
+	if err = self.clear(); err != nil {
+		return
+	}
+	self.buf = append(self.buf, p...)
+	for len(self.buf) >= BlobChunkSize {
+		if err = self.flush(BlobChunkSize); err != nil {
+			return
+		}
+	}
+	n = len(p)
+	return
+}
+
+func (self *blobWriter) Close() (err error) {
+	if err = self.clear(); err != nil {
+		return
+	}
+	if len(self.buf) > 0 || self.chunk == 0 {
+		err = self.flush(len(self.buf))
+	}
+	return
+}
+
+/*
+BlobReader returns a reader streaming the blob stored under keys, one chunk at a time.
+
+Reading a blob that doesn't exist will return an error with the message NoRecord.
+*/
+func (self *DB) BlobReader(keys [][]byte) io.Reader {
+	return &blobReader{
+		db:   self,
+		keys: keys,
+	}
+}
+
+/*
+BlobWriter returns a writer that splits everything written to it into chunks of BlobChunkSize
+bytes stored under keys. Any previous blob (or other values) under keys will be removed on the first
+write, and the last chunk will be written when the writer is closed.
+
+The chunks are written one at a time, so wrap the usage in Transact if the blob must appear atomically.
+*/
+func (self *DB) BlobWriter(keys [][]byte) io.WriteCloser {
+	return &blobWriter{
+		db:   self,
+		keys: keys,
+	}
+}
+
+/*
+SetBlob will replace the blob under keys with the contents of r within a single transaction.
+*/
+func (self *DB) SetBlob(keys [][]byte, r io.Reader) error {
+	return self.Transact(func(d *DB) (err error) {
+		w := d.BlobWriter(keys)
+		if _, err = io.Copy(w, r); err != nil {
+			return
+		}
+		return w.Close()
+	})
+}
+
+/*
+GetBlob returns the entire blob stored under keys.
+*/
+func (self *DB) GetBlob(keys [][]byte) (result []byte, err error) {
+	return ioutil.ReadAll(self.BlobReader(keys))
+}
+
+/*
+RemoveBlob removes all chunks of the blob under keys within a single transaction.
+*/
+func (self *DB) RemoveBlob(keys [][]byte) error {
+	return self.Transact(func(d *DB) error {
+		return d.ClearAll(keys)
+	})
+}
@@ -0,0 +1,181 @@
+package kc
+
+import (
+	"bytes"
+	"fmt"
+	"sync"
+)
+
+/*
+PreWriteHook is called inside the transaction of a Set or Remove of keys, before the write happens.
+
+value is the value about to be written, or nil if keys are about to be removed.
+
+The returned result will be written instead of value, and a nil result will remove keys instead.
+Returning an error will veto the write and make Set or Remove return that error.
+*/
+type PreWriteHook func(d *DB, keys [][]byte, value []byte) (result []byte, err error)
+
+/*
+PostCommitHook is called after a transaction has been committed, with all keys changed by the transaction.
+
+Errors returned by the hook are returned as PostCommitErrors by the committed write or transaction.
+*/
+type PostCommitHook func(d *DB, changed [][][]byte) error
+
+// PostCommitError is returned when a PostCommitHook fails after the changes have been committed.
+type PostCommitError struct {
+	Err error
+}
+
+func (self PostCommitError) Error() string {
+	return fmt.Sprintf("Committed, but a post commit hook failed: %v", self.Err)
+}
+
+type prefixHook struct {
+	prefix     [][]byte
+	preWrite   PreWriteHook
+	postCommit PostCommitHook
+}
+
+type hooks struct {
+	lock       *sync.RWMutex
+	preWrite   []prefixHook
+	postCommit []prefixHook
+}
+
+func newHooks() *hooks {
+	return &hooks{
+		lock: new(sync.RWMutex),
+	}
+}
+
+// hasPrefix returns whether keys starts with all the levels in prefix.
+func hasPrefix(keys, prefix [][]byte) bool {
+	if len(keys) < len(prefix) {
+		return false
+	}
+	for index, part := range prefix {
+		if bytes.Compare(keys[index], part) != 0 {
+			return false
+		}
+	}
+	return true
+}
+
+func (self *hooks) preWriteFor(keys [][]byte) (result []PreWriteHook) {
+	if self == nil {
+		return
+	}
+	self.lock.RLock()
+	defer self.lock.RUnlock()
+	for _, hook := range self.preWrite {
+		if hasPrefix(keys, hook.prefix) {
+			result = append(result, hook.preWrite)
+		}
+	}
+	return
+}
+
+// hasPostCommit returns whether any PostCommitHooks are registered.
+func (self *hooks) hasPostCommit() bool {
+	if self == nil {
+		return false
+	}
+	self.lock.RLock()
+	defer self.lock.RUnlock()
+	return len(self.postCommit) > 0
+}
+
+func (self *hooks) runPostCommit(d *DB, changed [][][]byte) (err error) {
+	if self == nil || len(changed) == 0 {
+		return
+	}
+	self.lock.RLock()
+	postCommit := self.postCommit
+	self.lock.RUnlock()
+	for _, hook := range postCommit {
+		var matching [][][]byte
+		for _, keys := range changed {
+			if hasPrefix(keys, hook.prefix) {
+				matching = append(matching, keys)
+			}
+		}
+		if len(matching) > 0 {
+			if err = hook.postCommit(d, matching); err != nil {
+				return PostCommitError{err}
+			}
+		}
+	}
+	return
+}
+
+/*
+PreWrite will register hook to be called before all Set and Remove calls on keys beginning with prefix.
+
+Hooks matching the same keys are called in the order they were registered, each receiving the result of the previous one.
+*/
+func (self *DB) PreWrite(prefix [][]byte, hook PreWriteHook) {
+	self.hooks.lock.Lock()
+	defer self.hooks.lock.Unlock()
+	self.hooks.preWrite = append(self.hooks.preWrite, prefixHook{
+		prefix:   prefix,
+		preWrite: hook,
+	})
+}
+
+/*
+PostCommit will register hook to be called after each transaction that changed keys beginning with prefix.
+
+Writes outside transactions will call hook at once.
+*/
+func (self *DB) PostCommit(prefix [][]byte, hook PostCommitHook) {
+	self.hooks.lock.Lock()
+	defer self.hooks.lock.Unlock()
+	self.hooks.postCommit = append(self.hooks.postCommit, prefixHook{
+		prefix:     prefix,
+		postCommit: hook,
+	})
+}
+
+func (self *DB) write(keys [][]byte, value []byte) (err error) {
+	preWrite := self.hooks.preWriteFor(keys)
+	if len(preWrite) > 0 && !self.inTransaction {
+		return self.Transact(func(d *DB) error {
+			return d.write(keys, value)
+		})
+	}
+	for _, hook := range preWrite {
+		if value, err = hook(self, keys, value); err != nil {
+			return
+		}
+	}
+	if value == nil {
+		err = self.KCDB.Remove(JoinKeys(keys))
+	} else {
+		err = self.KCDB.Set(JoinKeys(keys), value)
+	}
+	if err != nil {
+		return
+	}
+	return self.changed(keys)
+}
+
+func (self *DB) changed(keys [][]byte) error {
+	if !self.hooks.hasPostCommit() {
+		// Nobody wants to know
+		return nil
+	}
+	if self.inTransaction {
+		joined := string(JoinKeys(keys))
+		if self.changedKeys == nil {
+			self.changedKeys = make(map[string]bool)
+		}
+		if !self.changedKeys[joined] {
+			self.changedKeys[joined] = true
+			self.changedOrder = append(self.changedOrder, keys)
+		}
+		return nil
+	}
+	return self.hooks.runPostCommit(self, [][][]byte{keys})
+}
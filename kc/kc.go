@@ -49,6 +49,36 @@ func SplitKeys(key []byte) (result [][]byte) {
 	return
 }
 
+// ParseKeys splits a cabinet key into a key slice like SplitKeys, but returns an error if it is not a valid cabinet key
+func ParseKeys(key []byte) (result [][]byte, err error) {
+	var last []byte
+	for index := 0; index < len(key); index++ {
+		if key[index] == 0 {
+			if index+1 == len(key) {
+				err = fmt.Errorf("%v ends inside an escape sequence", key)
+				return
+			}
+			switch key[index+1] {
+			case 0:
+				last = append(last, 0)
+			case 1:
+				result = append(result, last)
+				last = nil
+			default:
+				err = fmt.Errorf("%v contains an invalid escape sequence", key)
+				return
+			}
+			index++
+		} else {
+			last = append(last, key[index])
+		}
+	}
+	if last != nil {
+		err = fmt.Errorf("%v ends with an unterminated key", key)
+	}
+	return
+}
+
 // Keyify is a utility to convert a set of strings and []byte to a [][]byte
 func Keyify(keys ...interface{}) (result [][]byte) {
 	for _, key := range keys {
@@ -71,6 +101,9 @@ type DB struct {
 	*cabinet.KCDB
 	inTransaction    bool
 	afterTransaction []func(*DB) error
+	hooks            *hooks
+	changedKeys      map[string]bool
+	changedOrder     [][][]byte
 }
 
 func (self *DB) String() string {
@@ -88,11 +121,19 @@ func New(path string) (result *DB, err error) {
 		return
 	}
 	result = &DB{
-		KCDB: kcdb,
+		KCDB:  kcdb,
+		hooks: newHooks(),
 	}
 	return
 }
 
+/*
+InTransaction returns whether the DB is inside a transaction.
+*/
+func (self *DB) InTransaction() bool {
+	return self.inTransaction
+}
+
 /*
 BetweenTransactions will run f at once if the DB is not inside a transaction,
 or run it after the current transaction is finished if it is inside a transaction.
@@ -132,14 +173,19 @@ func (self *DB) Transact(f func(d *DB) error) (err error) {
 			if err = f(&cpy); err == nil {
 				if err = self.EndTran(true); err != nil {
 					self.EndTran(false)
+					return
 				}
 				cpy.inTransaction = false
+				// The transaction is committed, so the callbacks run even if a hook fails
+				hookErr := self.hooks.runPostCommit(self, cpy.changedOrder)
+				cpy.changedKeys, cpy.changedOrder = nil, nil
 				for _, callback := range cpy.afterTransaction {
 					if err = callback(self); err != nil {
 						return
 					}
 				}
 				cpy.afterTransaction = nil
+				err = hookErr
 			} else {
 				self.EndTran(false)
 			}
@@ -2,6 +2,7 @@ package kc
 
 import (
 	"bytes"
+	"fmt"
 	"math/rand"
 	"reflect"
 	"testing"
@@ -58,6 +59,18 @@ func TestSplitJoin2(t *testing.T) {
 	}
 }
 
+func TestSplitParse(t *testing.T) {
+	keys := [][]byte{[]byte{0, 1}, []byte{}, []byte{1, 2}}
+	if parsed, err := ParseKeys(JoinKeys(keys)); err != nil || !reflect.DeepEqual(parsed, SplitKeys(JoinKeys(keys))) {
+		t.Errorf("Wanted %v, got %v, %v", SplitKeys(JoinKeys(keys)), parsed, err)
+	}
+	for _, invalid := range [][]byte{[]byte{0}, []byte{1, 0}, []byte{0, 2}, []byte{1, 0, 1, 2}} {
+		if parsed, err := ParseKeys(invalid); err == nil {
+			t.Errorf("Wanted an error for %v, got %v", invalid, parsed)
+		}
+	}
+}
+
 func TestCrud(t *testing.T) {
 	d, err := New("test")
 	if err != nil {
@@ -344,3 +357,141 @@ func TestSetOps3(t *testing.T) {
 		t.Errorf("%+v != %+v", found, wanted)
 	}
 }
+
+func TestBlobs(t *testing.T) {
+	d, err := New("test")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer d.Close()
+	d.Clear()
+	d.Set(Keyify("a"), []byte("1"))
+	d.Set(Keyify("c"), []byte("2"))
+	blob := make([]byte, BlobChunkSize*3+BlobChunkSize/2)
+	for index, _ := range blob {
+		blob[index] = byte(rand.Int() % 256)
+	}
+	if err := d.SetBlob(Keyify("b"), bytes.NewBuffer(blob)); err != nil {
+		t.Fatalf(err.Error())
+	}
+	if coll := d.GetCollection(Keyify("b")); len(coll) != 4 {
+		t.Errorf("Wanted 4 chunks, got %v", len(coll))
+	}
+	found, err := d.GetBlob(Keyify("b"))
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	if bytes.Compare(found, blob) != 0 {
+		t.Errorf("Wanted %v bytes, got %v different bytes", len(blob), len(found))
+	}
+	if err := d.SetBlob(Keyify("b"), bytes.NewBuffer([]byte("short"))); err != nil {
+		t.Fatalf(err.Error())
+	}
+	if found, err = d.GetBlob(Keyify("b")); err != nil || string(found) != "short" {
+		t.Errorf("Wanted short, got %v, %v", string(found), err)
+	}
+	if err := d.SetBlob(Keyify("b"), bytes.NewBuffer(nil)); err != nil {
+		t.Fatalf(err.Error())
+	}
+	if found, err = d.GetBlob(Keyify("b")); err != nil || len(found) != 0 {
+		t.Errorf("Wanted empty blob, got %v, %v", found, err)
+	}
+	if err := d.RemoveBlob(Keyify("b")); err != nil {
+		t.Fatalf(err.Error())
+	}
+	if _, err = d.GetBlob(Keyify("b")); err == nil || err.Error() != NoRecord {
+		t.Errorf("Wanted %v, got %v", NoRecord, err)
+	}
+	if count, _ := d.Count(); count != 2 {
+		t.Errorf("Wanted 2 records left, got %v", count)
+	}
+}
+
+func TestHooks(t *testing.T) {
+	d, err := New("test")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer d.Close()
+	d.Clear()
+	d.PreWrite(Keyify("guarded"), func(d *DB, keys [][]byte, value []byte) ([]byte, error) {
+		if value == nil {
+			return nil, fmt.Errorf("Can't remove %v", keys)
+		}
+		return append([]byte("rewritten "), value...), nil
+	})
+	var committed [][][]byte
+	d.PostCommit(Keyify("guarded"), func(d *DB, changed [][][]byte) error {
+		committed = append(committed, changed...)
+		return nil
+	})
+	if err := d.Transact(func(d *DB) (err error) {
+		if err = d.Set(Keyify("guarded", "a"), []byte("value")); err != nil {
+			return
+		}
+		if err = d.Set(Keyify("guarded", "a"), []byte("value")); err != nil {
+			return
+		}
+		if err = d.Set(Keyify("guarded", "b"), []byte("value")); err != nil {
+			return
+		}
+		if len(committed) != 0 {
+			t.Errorf("Wanted no committed keys inside the transaction, got %v", committed)
+		}
+		return d.Set(Keyify("other"), []byte("value"))
+	}); err != nil {
+		t.Fatalf(err.Error())
+	}
+	if v, err := d.Get(Keyify("guarded", "a")); err != nil || string(v) != "rewritten value" {
+		t.Errorf("Wanted rewritten value, got %v, %v", string(v), err)
+	}
+	if v, err := d.Get(Keyify("other")); err != nil || string(v) != "value" {
+		t.Errorf("Wanted value, got %v, %v", string(v), err)
+	}
+	if wanted := [][][]byte{Keyify("guarded", "a"), Keyify("guarded", "b")}; !reflect.DeepEqual(committed, wanted) {
+		t.Errorf("Wanted %v to be committed, got %v", wanted, committed)
+	}
+	if err := d.Remove(Keyify("guarded", "a")); err == nil {
+		t.Errorf("Wanted the remove to be vetoed")
+	}
+	if _, err := d.Get(Keyify("guarded", "a")); err != nil {
+		t.Errorf("Wanted the value to remain, got %v", err)
+	}
+	if err := d.Remove(Keyify("other")); err != nil {
+		t.Errorf(err.Error())
+	}
+	if len(committed) != 2 {
+		t.Errorf("Wanted no more committed keys, got %v", committed)
+	}
+	if err := d.ClearAll(Keyify("guarded")); err == nil {
+		t.Errorf("Wanted ClearAll to be vetoed")
+	}
+	if err := d.RemoveBlob(Keyify("guarded")); err == nil {
+		t.Errorf("Wanted RemoveBlob to be vetoed")
+	}
+	if _, err := d.Get(Keyify("guarded", "a")); err != nil {
+		t.Errorf("Wanted the value to remain, got %v", err)
+	}
+	d.PostCommit(Keyify("failing"), func(d *DB, changed [][][]byte) error {
+		return fmt.Errorf("Failing hook")
+	})
+	called := false
+	err = d.Transact(func(d *DB) error {
+		if err := d.BetweenTransactions(func(d *DB) error {
+			called = true
+			return nil
+		}); err != nil {
+			return err
+		}
+		return d.Set(Keyify("failing", "a"), []byte("value"))
+	})
+	if _, ok := err.(PostCommitError); !ok {
+		t.Errorf("Wanted a PostCommitError, got %v", err)
+	}
+	if !called {
+		t.Errorf("Wanted the callbacks to run after a failing hook")
+	}
+	if v, err := d.Get(Keyify("failing", "a")); err != nil || string(v) != "value" {
+		t.Errorf("Wanted the value to be committed, got %v, %v", string(v), err)
+	}
+}
@@ -46,17 +46,26 @@ func (self *Cursor) JumpKey(keys ...[]byte) (err error) {
 
 // http://godoc.org/bitbucket.org/ww/cabinet#KCDB.Add
 func (self *DB) Add(keys [][]byte, value []byte) (err error) {
-	return self.KCDB.Add(JoinKeys(keys), value)
+	if err = self.KCDB.Add(JoinKeys(keys), value); err == nil {
+		err = self.changed(keys)
+	}
+	return
 }
 
 // http://godoc.org/bitbucket.org/ww/cabinet#KCDB.Append
 func (self *DB) Append(keys [][]byte, value []byte) (err error) {
-	return self.KCDB.Append(JoinKeys(keys), value)
+	if err = self.KCDB.Append(JoinKeys(keys), value); err == nil {
+		err = self.changed(keys)
+	}
+	return
 }
 
 // http://godoc.org/bitbucket.org/ww/cabinet#KCDB.Cas
 func (self *DB) Cas(keys [][]byte, oval, nval []byte) (err error) {
-	return self.KCDB.Cas(JoinKeys(keys), oval, nval)
+	if err = self.KCDB.Cas(JoinKeys(keys), oval, nval); err == nil {
+		err = self.changed(keys)
+	}
+	return
 }
 
 // http://godoc.org/bitbucket.org/ww/cabinet#KCDB.Cursor
@@ -75,12 +84,18 @@ func (self *DB) Get(keys [][]byte) (value []byte, err error) {
 
 // http://godoc.org/bitbucket.org/ww/cabinet#KCDB.IncrDouble
 func (self *DB) IncrDouble(keys [][]byte, amount float64) (err error) {
-	return self.KCDB.IncrDouble(JoinKeys(keys), amount)
+	if err = self.KCDB.IncrDouble(JoinKeys(keys), amount); err == nil {
+		err = self.changed(keys)
+	}
+	return
 }
 
 // http://godoc.org/bitbucket.org/ww/cabinet#KCDB.IncrInt
 func (self *DB) IncrInt(keys [][]byte, amount int64) (result int64, err error) {
-	return self.KCDB.IncrInt(JoinKeys(keys), amount)
+	if result, err = self.KCDB.IncrInt(JoinKeys(keys), amount); err == nil {
+		err = self.changed(keys)
+	}
+	return
 }
 
 // http://godoc.org/bitbucket.org/ww/cabinet#KCDB.Keys
@@ -126,16 +141,24 @@ func (self *DB) Merge(dbs []*DB, mode int) (err error) {
 }
 
 // http://godoc.org/bitbucket.org/ww/cabinet#KCDB.Remove
+// Remove will run any PreWriteHook registered for keys.
 func (self *DB) Remove(keys [][]byte) (err error) {
-	return self.KCDB.Remove(JoinKeys(keys))
+	return self.write(keys, nil)
 }
 
 // http://godoc.org/bitbucket.org/ww/cabinet#KCDB.Replace
 func (self *DB) Replace(keys [][]byte, value []byte) (err error) {
-	return self.KCDB.Replace(JoinKeys(keys), value)
+	if err = self.KCDB.Replace(JoinKeys(keys), value); err == nil {
+		err = self.changed(keys)
+	}
+	return
 }
 
 // http://godoc.org/bitbucket.org/ww/cabinet#KCDB.Set
+// Set will run any PreWriteHook registered for keys.
 func (self *DB) Set(keys [][]byte, value []byte) (err error) {
-	return self.KCDB.Set(JoinKeys(keys), value)
+	if value == nil {
+		value = []byte{}
+	}
+	return self.write(keys, value)
 }
@@ -40,6 +40,18 @@ func (self *DB) SetOp(expr *setop.SetExpression) (result []KV) {
 	return
 }
 
+/*
+SetOpCount will run expr on this DB and return the number of results.
+*/
+func (self *DB) SetOpCount(expr *setop.SetExpression) (result int) {
+	if err := expr.Each(self.skipper, func(res *setop.SetOpResult) {
+		result++
+	}); err != nil {
+		panic(err)
+	}
+	return
+}
+
 func (self *DB) skipperString(b []byte) (result setop.Skipper, err error) {
 	keyParts := strings.Split(string(b), "/")
 	keys := make([][]byte, len(keyParts))
@@ -73,28 +85,53 @@ func (self *DB) SetOpString(expr string) (result []KV) {
 }
 
 /*
-ClearAll removes all values under keys.
+ClearAll removes all values under keys, and returns the first error, for example from a PreWriteHook vetoing a removal.
 */
-func (self *DB) ClearAll(keys [][]byte) {
-	self.each(keys, func(keys1 [][]byte, v []byte) {
-		self.Remove(keys1)
+func (self *DB) ClearAll(keys [][]byte) (err error) {
+	self.each(keys, func(keys1 [][]byte, v []byte) bool {
+		err = self.Remove(keys1)
+		return err != nil
 	})
+	return
 }
 
 /*
 GetCollections returns the sorted key/value pairs under keys.
 */
 func (self *DB) GetCollection(keys [][]byte) (result []KV) {
-	self.each(keys, func(keys1 [][]byte, v []byte) {
+	self.each(keys, func(keys1 [][]byte, v []byte) bool {
 		result = append(result, KV{
 			Keys:  keys1,
 			Value: v,
 		})
+		return false
+	})
+	return
+}
+
+/*
+CountCollection returns the number of key/value pairs under keys.
+*/
+func (self *DB) CountCollection(keys [][]byte) (result int) {
+	self.each(keys, func(keys1 [][]byte, v []byte) bool {
+		result++
+		return false
+	})
+	return
+}
+
+/*
+HasCollection returns whether there are any key/value pairs under keys.
+*/
+func (self *DB) HasCollection(keys [][]byte) (result bool) {
+	self.each(keys, func(keys1 [][]byte, v []byte) bool {
+		result = true
+		return true
 	})
 	return
 }
 
-func (self *DB) each(keys [][]byte, f func(keys [][]byte, value []byte)) {
+func (self *DB) each(keys [][]byte, f func(keys [][]byte, value []byte) (done bool)) {
 	joined := JoinKeys(keys)
 	cursor := self.KCDB.Cursor()
 	var err error
@@ -115,7 +152,9 @@ func (self *DB) each(keys [][]byte, f func(keys [][]byte, value []byte)) {
 		if len(key) > len(joined) && bytes.Compare(joined, key[:len(joined)]) == 0 {
 			splitKey := SplitKeys(key)
 			if len(splitKey) > len(keys) {
-				f(splitKey, value)
+				if f(splitKey, value) {
+					return
+				}
 			}
 		} else {
 			break
@@ -0,0 +1,440 @@
+package kol
+
+import (
+	"bytes"
+	"encoding"
+	"encoding/binary"
+	"encoding/gob"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+	"reflect"
+	"sync"
+)
+
+/*
+Codec is used to serialize objects into the database.
+
+The Tag of the Codec used is stored before each record, so that records can be decoded with the right
+Codec even after the Codec for a type has been changed.
+*/
+type Codec interface {
+	Tag() byte
+	Marshal(obj interface{}) ([]byte, error)
+	Unmarshal(b []byte, obj interface{}) error
+}
+
+var (
+	// JSONCodec serializes objects using encoding/json. It is the default Codec.
+	JSONCodec Codec = jsonCodec{}
+	// GobCodec serializes objects using encoding/gob.
+	GobCodec Codec = gobCodec{}
+	// BinaryCodec serializes objects into a compact binary format with the exported fields identified by name.
+	BinaryCodec Codec = binaryCodec{}
+)
+
+// legacyJSONTag is the first byte of untagged JSON records written before codecs were introduced.
+const legacyJSONTag = '{'
+
+type codecs struct {
+	lock         *sync.RWMutex
+	defaultCodec Codec
+	types        map[reflect.Type]Codec
+	tags         map[byte]Codec
+}
+
+func newCodecs() (result *codecs) {
+	result = &codecs{
+		lock:         new(sync.RWMutex),
+		defaultCodec: JSONCodec,
+		types:        make(map[reflect.Type]Codec),
+		tags:         make(map[byte]Codec),
+	}
+	for _, codec := range []Codec{JSONCodec, GobCodec, BinaryCodec} {
+		result.tags[codec.Tag()] = codec
+	}
+	return
+}
+
+// RegisterCodec will make it possible to decode records stored with codec.
+func (self *DB) RegisterCodec(codec Codec) {
+	self.codecs.lock.Lock()
+	defer self.codecs.lock.Unlock()
+	if codec.Tag() == legacyJSONTag {
+		panic(fmt.Errorf("%v can not use the tag %q", codec, codec.Tag()))
+	}
+	self.codecs.tags[codec.Tag()] = codec
+}
+
+// SetDefaultCodec will make codec encode all types that don't have a Codec of their own.
+func (self *DB) SetDefaultCodec(codec Codec) {
+	self.RegisterCodec(codec)
+	self.codecs.lock.Lock()
+	defer self.codecs.lock.Unlock()
+	self.codecs.defaultCodec = codec
+}
+
+// SetCodec will make codec encode all objects with the same type as obj.
+func (self *DB) SetCodec(obj interface{}, codec Codec) {
+	self.RegisterCodec(codec)
+	typ := reflect.TypeOf(obj)
+	for typ.Kind() == reflect.Ptr {
+		typ = typ.Elem()
+	}
+	self.codecs.lock.Lock()
+	defer self.codecs.lock.Unlock()
+	self.codecs.types[typ] = codec
+}
+
+func (self *DB) encode(typ reflect.Type, obj interface{}) (result []byte, err error) {
+	self.codecs.lock.RLock()
+	codec, found := self.codecs.types[typ]
+	if !found {
+		codec = self.codecs.defaultCodec
+	}
+	self.codecs.lock.RUnlock()
+	var b []byte
+	if b, err = codec.Marshal(obj); err != nil {
+		return
+	}
+	result = make([]byte, len(b)+1)
+	result[0] = codec.Tag()
+	copy(result[1:], b)
+	return
+}
+
+func (self *DB) decode(b []byte, obj interface{}) (err error) {
+	if len(b) == 0 {
+		return fmt.Errorf("Can't decode empty record")
+	}
+	if b[0] == legacyJSONTag {
+		return json.Unmarshal(b, obj)
+	}
+	self.codecs.lock.RLock()
+	codec, found := self.codecs.tags[b[0]]
+	self.codecs.lock.RUnlock()
+	if !found {
+		return fmt.Errorf("No Codec registered for tag %q", b[0])
+	}
+	return codec.Unmarshal(b[1:], obj)
+}
+
+type jsonCodec struct{}
+
+func (self jsonCodec) Tag() byte {
+	return 'j'
+}
+
+func (self jsonCodec) Marshal(obj interface{}) ([]byte, error) {
+	return json.Marshal(obj)
+}
+
+func (self jsonCodec) Unmarshal(b []byte, obj interface{}) error {
+	return json.Unmarshal(b, obj)
+}
+
+type gobCodec struct{}
+
+func (self gobCodec) Tag() byte {
+	return 'g'
+}
+
+func (self gobCodec) Marshal(obj interface{}) (result []byte, err error) {
+	buf := new(bytes.Buffer)
+	if err = gob.NewEncoder(buf).Encode(obj); err != nil {
+		return
+	}
+	result = buf.Bytes()
+	return
+}
+
+func (self gobCodec) Unmarshal(b []byte, obj interface{}) error {
+	return gob.NewDecoder(bytes.NewBuffer(b)).Decode(obj)
+}
+
+type binaryCodec struct{}
+
+func (self binaryCodec) Tag() byte {
+	return 'b'
+}
+
+func (self binaryCodec) Marshal(obj interface{}) (result []byte, err error) {
+	buf := new(bytes.Buffer)
+	if err = binaryEncode(buf, reflect.Indirect(reflect.ValueOf(obj))); err != nil {
+		return
+	}
+	result = buf.Bytes()
+	return
+}
+
+func (self binaryCodec) Unmarshal(b []byte, obj interface{}) error {
+	value := reflect.ValueOf(obj)
+	if value.Kind() != reflect.Ptr || value.IsNil() {
+		return fmt.Errorf("%v is not a pointer", obj)
+	}
+	return binaryDecode(bytes.NewReader(b), value.Elem())
+}
+
+var binaryMarshalerType = reflect.TypeOf((*encoding.BinaryMarshaler)(nil)).Elem()
+var binaryUnmarshalerType = reflect.TypeOf((*encoding.BinaryUnmarshaler)(nil)).Elem()
+
+// binaryMarshaled returns whether values of typ are encoded using their own MarshalBinary and UnmarshalBinary methods.
+func binaryMarshaled(typ reflect.Type) bool {
+	ptrType := reflect.PtrTo(typ)
+	return typ.Kind() != reflect.Ptr && ptrType.Implements(binaryMarshalerType) && ptrType.Implements(binaryUnmarshalerType)
+}
+
+func writeUvarint(buf *bytes.Buffer, i uint64) {
+	b := make([]byte, binary.MaxVarintLen64)
+	buf.Write(b[:binary.PutUvarint(b, i)])
+}
+
+func writeVarint(buf *bytes.Buffer, i int64) {
+	b := make([]byte, binary.MaxVarintLen64)
+	buf.Write(b[:binary.PutVarint(b, i)])
+}
+
+func writeBytes(buf *bytes.Buffer, b []byte) {
+	writeUvarint(buf, uint64(len(b)))
+	buf.Write(b)
+}
+
+func readBytes(r *bytes.Reader) (result []byte, err error) {
+	var l uint64
+	if l, err = binary.ReadUvarint(r); err != nil {
+		return
+	}
+	if l > uint64(r.Len()) {
+		err = io.ErrUnexpectedEOF
+		return
+	}
+	result = make([]byte, l)
+	_, err = io.ReadFull(r, result)
+	return
+}
+
+func binaryEncode(buf *bytes.Buffer, value reflect.Value) (err error) {
+	if binaryMarshaled(value.Type()) {
+		ptr := reflect.New(value.Type())
+		ptr.Elem().Set(value)
+		var b []byte
+		if b, err = ptr.Interface().(encoding.BinaryMarshaler).MarshalBinary(); err != nil {
+			return
+		}
+		writeBytes(buf, b)
+		return
+	}
+	switch value.Kind() {
+	case reflect.Bool:
+		if value.Bool() {
+			buf.WriteByte(1)
+		} else {
+			buf.WriteByte(0)
+		}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		writeVarint(buf, value.Int())
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		writeUvarint(buf, value.Uint())
+	case reflect.Float32, reflect.Float64:
+		b := make([]byte, 8)
+		binary.BigEndian.PutUint64(b, math.Float64bits(value.Float()))
+		buf.Write(b)
+	case reflect.String:
+		writeBytes(buf, []byte(value.String()))
+	case reflect.Ptr:
+		if value.IsNil() {
+			buf.WriteByte(0)
+		} else {
+			buf.WriteByte(1)
+			err = binaryEncode(buf, value.Elem())
+		}
+	case reflect.Slice:
+		if value.IsNil() {
+			writeUvarint(buf, 0)
+		} else if value.Type().Elem().Kind() == reflect.Uint8 {
+			writeUvarint(buf, uint64(value.Len())+1)
+			buf.Write(value.Bytes())
+		} else {
+			writeUvarint(buf, uint64(value.Len())+1)
+			for i := 0; i < value.Len(); i++ {
+				if err = binaryEncode(buf, value.Index(i)); err != nil {
+					return
+				}
+			}
+		}
+	case reflect.Array:
+		for i := 0; i < value.Len(); i++ {
+			if err = binaryEncode(buf, value.Index(i)); err != nil {
+				return
+			}
+		}
+	case reflect.Map:
+		if value.IsNil() {
+			writeUvarint(buf, 0)
+		} else {
+			writeUvarint(buf, uint64(value.Len())+1)
+			for _, key := range value.MapKeys() {
+				if err = binaryEncode(buf, key); err != nil {
+					return
+				}
+				if err = binaryEncode(buf, value.MapIndex(key)); err != nil {
+					return
+				}
+			}
+		}
+	case reflect.Struct:
+		typ := value.Type()
+		var fields []int
+		for i := 0; i < typ.NumField(); i++ {
+			if typ.Field(i).PkgPath == "" {
+				fields = append(fields, i)
+			}
+		}
+		writeUvarint(buf, uint64(len(fields)))
+		for _, i := range fields {
+			fieldBuf := new(bytes.Buffer)
+			if err = binaryEncode(fieldBuf, value.Field(i)); err != nil {
+				return
+			}
+			writeBytes(buf, []byte(typ.Field(i).Name))
+			writeBytes(buf, fieldBuf.Bytes())
+		}
+	default:
+		err = fmt.Errorf("%v is not encodable by the BinaryCodec", value.Type())
+	}
+	return
+}
+
+func binaryDecode(r *bytes.Reader, value reflect.Value) (err error) {
+	if binaryMarshaled(value.Type()) {
+		var b []byte
+		if b, err = readBytes(r); err != nil {
+			return
+		}
+		return value.Addr().Interface().(encoding.BinaryUnmarshaler).UnmarshalBinary(b)
+	}
+	switch value.Kind() {
+	case reflect.Bool:
+		var b byte
+		if b, err = r.ReadByte(); err != nil {
+			return
+		}
+		value.SetBool(b != 0)
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		var i int64
+		if i, err = binary.ReadVarint(r); err != nil {
+			return
+		}
+		if value.OverflowInt(i) {
+			return fmt.Errorf("%v overflows %v", i, value.Type())
+		}
+		value.SetInt(i)
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		var i uint64
+		if i, err = binary.ReadUvarint(r); err != nil {
+			return
+		}
+		if value.OverflowUint(i) {
+			return fmt.Errorf("%v overflows %v", i, value.Type())
+		}
+		value.SetUint(i)
+	case reflect.Float32, reflect.Float64:
+		b := make([]byte, 8)
+		if _, err = io.ReadFull(r, b); err != nil {
+			return
+		}
+		value.SetFloat(math.Float64frombits(binary.BigEndian.Uint64(b)))
+	case reflect.String:
+		var b []byte
+		if b, err = readBytes(r); err != nil {
+			return
+		}
+		value.SetString(string(b))
+	case reflect.Ptr:
+		var b byte
+		if b, err = r.ReadByte(); err != nil {
+			return
+		}
+		if b == 0 {
+			value.Set(reflect.Zero(value.Type()))
+		} else {
+			if value.IsNil() {
+				value.Set(reflect.New(value.Type().Elem()))
+			}
+			err = binaryDecode(r, value.Elem())
+		}
+	case reflect.Slice:
+		var l uint64
+		if l, err = binary.ReadUvarint(r); err != nil {
+			return
+		}
+		if l == 0 {
+			value.Set(reflect.Zero(value.Type()))
+			return
+		}
+		l--
+		if l > uint64(r.Len()) {
+			return io.ErrUnexpectedEOF
+		}
+		value.Set(reflect.MakeSlice(value.Type(), int(l), int(l)))
+		if value.Type().Elem().Kind() == reflect.Uint8 {
+			_, err = io.ReadFull(r, value.Bytes())
+			return
+		}
+		for i := 0; i < int(l); i++ {
+			if err = binaryDecode(r, value.Index(i)); err != nil {
+				return
+			}
+		}
+	case reflect.Array:
+		for i := 0; i < value.Len(); i++ {
+			if err = binaryDecode(r, value.Index(i)); err != nil {
+				return
+			}
+		}
+	case reflect.Map:
+		var l uint64
+		if l, err = binary.ReadUvarint(r); err != nil {
+			return
+		}
+		if l == 0 {
+			value.Set(reflect.Zero(value.Type()))
+			return
+		}
+		value.Set(reflect.MakeMap(value.Type()))
+		for i := uint64(1); i < l; i++ {
+			key := reflect.New(value.Type().Key()).Elem()
+			if err = binaryDecode(r, key); err != nil {
+				return
+			}
+			elem := reflect.New(value.Type().Elem()).Elem()
+			if err = binaryDecode(r, elem); err != nil {
+				return
+			}
+			value.SetMapIndex(key, elem)
+		}
+	case reflect.Struct:
+		var n uint64
+		if n, err = binary.ReadUvarint(r); err != nil {
+			return
+		}
+		for i := uint64(0); i < n; i++ {
+			var name, b []byte
+			if name, err = readBytes(r); err != nil {
+				return
+			}
+			if b, err = readBytes(r); err != nil {
+				return
+			}
+			if field, found := value.Type().FieldByName(string(name)); found && field.PkgPath == "" && len(field.Index) == 1 {
+				if err = binaryDecode(bytes.NewReader(b), value.FieldByIndex(field.Index)); err != nil {
+					return
+				}
+			}
+		}
+	default:
+		err = fmt.Errorf("%v is not decodable by the BinaryCodec", value.Type())
+	}
+	return
+}
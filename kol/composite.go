@@ -0,0 +1,224 @@
+package kol
+
+import (
+	"fmt"
+	"reflect"
+	"regexp"
+	"strings"
+	"sync"
+
+	"github.com/zond/kcwraps/kc"
+	"github.com/zond/setop"
+)
+
+const (
+	compositeIndex = "ci"
+)
+
+var compositePattern = regexp.MustCompile("composite<([^>]+)>")
+
+// composite is the ordered field names of a composite index.
+type composite []string
+
+func (self composite) name() string {
+	return strings.Join(self, "+")
+}
+
+var compositesMutex = new(sync.RWMutex)
+var registeredComposites = make(map[reflect.Type][]composite)
+
+/*
+RegisterComposite will make kol maintain a composite index of fields, in order, for the type of obj.
+
+A composite index can also be declared by tagging any field of the type with kol:"composite<Field1+Field2>".
+
+Queries using an And of Equals filters for a prefix of the fields, optionally followed by a range filter for the
+next field, will use the composite index instead of intersecting the indices of the separate fields.
+*/
+func RegisterComposite(obj interface{}, fields ...string) {
+	typ := reflect.TypeOf(obj)
+	for typ.Kind() == reflect.Ptr {
+		typ = typ.Elem()
+	}
+	compositesMutex.Lock()
+	defer compositesMutex.Unlock()
+	registeredComposites[typ] = append(registeredComposites[typ], composite(fields))
+}
+
+// composites returns the composite indices declared by tags in, or registered for, typ.
+func composites(typ reflect.Type) (result []composite) {
+	seen := make(map[string]bool)
+	for _, field := range taggedFields(typ) {
+		for _, param := range field.params {
+			if match := compositePattern.FindStringSubmatch(param); match != nil {
+				c := composite(strings.Split(match[1], "+"))
+				if !seen[c.name()] {
+					result = append(result, c)
+					seen[c.name()] = true
+				}
+			}
+		}
+	}
+	compositesMutex.RLock()
+	defer compositesMutex.RUnlock()
+	for _, c := range registeredComposites[typ] {
+		if !seen[c.name()] {
+			result = append(result, c)
+			seen[c.name()] = true
+		}
+	}
+	return
+}
+
+func compositeKey(id []byte, value reflect.Value, typ reflect.Type, c composite) (keys [][]byte, err error) {
+	keys = [][]byte{
+		[]byte(compositeIndex),
+		[]byte(typeName(typ)),
+		[]byte(c.name()),
+	}
+	for _, fieldName := range c {
+		var field reflect.Value
+		if field, err = fieldByPath(value, fieldName); err != nil {
+			err = fmt.Errorf("%v has a composite index %v, but there is no field named %v", typeName(typ), c.name(), fieldName)
+			return
+		}
+		if !field.IsValid() {
+			// Inside a nil struct pointer, so not indexed
+			keys = nil
+			return
+		}
+		var valuePart []byte
+		if valuePart, err = indexBytes(field.Type(), field); err != nil {
+			return
+		}
+		keys = append(keys, valuePart)
+	}
+	keys = append(keys, id)
+	return
+}
+
+// ranger is implemented by the QFilters that define a range of values of a field.
+type ranger interface {
+	indexRange() indexRange
+}
+
+/*
+compositeSource returns a source using the composite index of typ covering the most of the filters,
+and the filters not covered by it.
+
+A composite index covers an Equals filter for each field of a prefix of its fields, and optionally a range filter
+for the field following that prefix, unless any of the other fields can be inside nil struct pointers. found is false
+unless some composite index covers at least two filters.
+*/
+func (self And) compositeSource(db *DB, typ reflect.Type) (result setop.SetOpSource, rest And, found bool, err error) {
+	equals := make(map[string]int)
+	ranges := make(map[string]int)
+	for i, filter := range self {
+		switch f := filter.(type) {
+		case Equals:
+			if _, seen := equals[f.Field]; !seen {
+				equals[f.Field] = i
+			}
+		case ranger:
+			if _, seen := ranges[f.indexRange().field]; !seen {
+				ranges[f.indexRange().field] = i
+			}
+		}
+	}
+	var best composite
+	var bestEquals []int
+	bestRange := -1
+	for _, c := range composites(typ) {
+		var used []int
+		rangeIndex := -1
+		for _, field := range c {
+			if i, ok := equals[field]; ok {
+				used = append(used, i)
+				continue
+			}
+			if i, ok := ranges[field]; ok {
+				rangeIndex = i
+			}
+			break
+		}
+		covered := len(used)
+		if rangeIndex != -1 {
+			covered++
+		}
+		// Records with uncovered fields inside nil struct pointers have no entries in the composite index
+		for _, field := range c[covered:] {
+			if nillablePath(typ, field) {
+				covered = 0
+				break
+			}
+		}
+		bestCovered := len(bestEquals)
+		if bestRange != -1 {
+			bestCovered++
+		}
+		if covered > 1 && covered > bestCovered {
+			best, bestEquals, bestRange = c, used, rangeIndex
+		}
+	}
+	if best == nil {
+		return
+	}
+	found = true
+	keys := [][]byte{
+		[]byte(compositeIndex),
+		[]byte(typeName(typ)),
+		[]byte(best.name()),
+	}
+	covered := make(map[int]bool)
+	for _, i := range bestEquals {
+		eq := self[i].(Equals)
+		var b []byte
+		if b, err = filterBytes(typ, eq.Field, eq.Value); err != nil {
+			return
+		}
+		keys = append(keys, b)
+		covered[i] = true
+	}
+	for i, filter := range self {
+		if !covered[i] && i != bestRange {
+			rest = append(rest, filter)
+		}
+	}
+	depth := len(best) - len(bestEquals)
+	if depth == 0 {
+		result.Key = kc.JoinKeys(keys)
+		return
+	}
+	var min, max []byte
+	accept := func(b []byte) (ok, done bool) {
+		return true, false
+	}
+	if bestRange != -1 {
+		rng := self[bestRange].(ranger).indexRange()
+		if min, max, err = rng.bounds(typ); err != nil {
+			return
+		}
+		accept = func(b []byte) (ok, done bool) {
+			return rng.accept(min, max, b)
+		}
+	}
+	var tuples [][][]byte
+	if tuples, err = db.distinctValues(keys, depth, min, accept); err != nil {
+		return
+	}
+	if len(tuples) == 0 {
+		result = emptySource(typ)
+		return
+	}
+	op := setop.SetOp{
+		Merge: setop.First,
+		Type:  setop.Union,
+	}
+	for _, tuple := range tuples {
+		op.Sources = append(op.Sources, setop.SetOpSource{
+			Key: kc.JoinKeys(append(append([][]byte{}, keys...), tuple...)),
+		})
+	}
+	result.SetOp = &op
+	return
+}
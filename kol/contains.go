@@ -0,0 +1,71 @@
+package kol
+
+import (
+	"reflect"
+
+	"github.com/zond/setop"
+)
+
+// Contains is a QFilter that matches multi valued fields having Value as one of their elements.
+type Contains struct {
+	Field string
+	Value interface{}
+}
+
+func (self Contains) source(db *DB, typ reflect.Type) (result setop.SetOpSource, err error) {
+	return Equals{self.Field, self.Value}.source(db, typ)
+}
+
+func (self Contains) match(db *DB, typ reflect.Type, value reflect.Value) (result bool, err error) {
+	return Equals{self.Field, self.Value}.match(db, typ, value)
+}
+
+// ContainsAny is a QFilter that matches multi valued fields having at least one of Values as elements.
+type ContainsAny struct {
+	Field  string
+	Values []interface{}
+}
+
+func (self ContainsAny) filter() (result Or) {
+	for _, value := range self.Values {
+		result = append(result, Equals{self.Field, value})
+	}
+	return
+}
+
+func (self ContainsAny) source(db *DB, typ reflect.Type) (result setop.SetOpSource, err error) {
+	if len(self.Values) == 0 {
+		result = emptySource(typ)
+		return
+	}
+	return self.filter().source(db, typ)
+}
+
+func (self ContainsAny) match(db *DB, typ reflect.Type, value reflect.Value) (result bool, err error) {
+	return self.filter().match(db, typ, value)
+}
+
+// ContainsAll is a QFilter that matches multi valued fields having all of Values as elements.
+type ContainsAll struct {
+	Field  string
+	Values []interface{}
+}
+
+func (self ContainsAll) filter() (result And) {
+	for _, value := range self.Values {
+		result = append(result, Equals{self.Field, value})
+	}
+	return
+}
+
+func (self ContainsAll) source(db *DB, typ reflect.Type) (result setop.SetOpSource, err error) {
+	if len(self.Values) == 0 {
+		result = allSource(typ)
+		return
+	}
+	return self.filter().source(db, typ)
+}
+
+func (self ContainsAll) match(db *DB, typ reflect.Type, value reflect.Value) (result bool, err error) {
+	return self.filter().match(db, typ, value)
+}
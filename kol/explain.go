@@ -0,0 +1,208 @@
+package kol
+
+import (
+	"bytes"
+	"encoding/hex"
+	"fmt"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/zond/kcwraps/kc"
+	"github.com/zond/setop"
+)
+
+/*
+Plan describes the set operations a Query uses to find its matches.
+
+Operations have the Operation Union, Intersection or Difference and a number of Sources,
+and sources reading a collection of index or record keys have the Operation Key.
+*/
+type Plan struct {
+	Operation string
+	// Key is a readable version of the collection read by a Key source, like 2i/main.User/Name/"John".
+	Key string
+	// Keyspace is the keyspace read by a Key source, like pk for records, 2i for secondary indices or ft for full-text indices.
+	Keyspace string
+	Sources  []*Plan
+	// Order describes the order in which the matches are visited, and is only set for the root of the Plan.
+	Order string
+	// Filtered is true for the root of the Plan if the query scans the records found by the Plan to evaluate
+	// filters on fields without indices.
+	Filtered bool
+	// Traced is true if Count and Duration have been measured by executing the Plan.
+	Traced bool
+	// Count is the number of keys produced by this part of the Plan, measured by executing it separately.
+	Count int
+	// Duration is the time it took to produce the keys of this part of the Plan, measured by executing it separately,
+	// so it includes the Durations of its Sources.
+	Duration time.Duration
+	// Matches is the number of matches found when running the whole query, and is only set for the root of a traced Plan.
+	Matches int
+	// Elapsed is the time it took to run the whole query, including ordering, ranking and filtering by scanning, and
+	// is only set for the root of a traced Plan.
+	Elapsed time.Duration
+}
+
+func (self *Plan) String() string {
+	buf := &bytes.Buffer{}
+	self.write(buf, 0)
+	return buf.String()
+}
+
+func (self *Plan) write(buf *bytes.Buffer, depth int) {
+	fmt.Fprint(buf, strings.Repeat("  ", depth))
+	if self.Operation == planKey {
+		fmt.Fprint(buf, self.Key)
+	} else {
+		fmt.Fprint(buf, self.Operation)
+	}
+	if self.Traced {
+		fmt.Fprintf(buf, " [%v keys in %v]", self.Count, self.Duration)
+	}
+	if self.Order != "" {
+		fmt.Fprintf(buf, " ordered by %v", self.Order)
+	}
+	if self.Filtered {
+		fmt.Fprint(buf, " filtered by scanning")
+	}
+	if self.Traced && self.Order != "" {
+		fmt.Fprintf(buf, " [%v matches in %v]", self.Matches, self.Elapsed)
+	}
+	fmt.Fprintln(buf)
+	for _, source := range self.Sources {
+		source.write(buf, depth+1)
+	}
+}
+
+const planKey = "Key"
+
+func operationName(typ setop.SetOpType) string {
+	switch typ {
+	case setop.Union:
+		return "Union"
+	case setop.Intersection:
+		return "Intersection"
+	case setop.Difference:
+		return "Difference"
+	}
+	return fmt.Sprint(typ)
+}
+
+// readableKey renders the levels of key as text if they are printable, and as hex otherwise.
+func readableKey(key []byte) string {
+	var parts []string
+	for index, level := range kc.SplitKeys(key) {
+		printable := utf8.Valid(level)
+		for _, r := range string(level) {
+			printable = printable && unicode.IsPrint(r)
+		}
+		switch {
+		case printable && index < 3:
+			// Keyspace, type and field names
+			parts = append(parts, string(level))
+		case printable:
+			parts = append(parts, strconv.Quote(string(level)))
+		default:
+			parts = append(parts, "0x"+hex.EncodeToString(level))
+		}
+	}
+	return strings.Join(parts, "/")
+}
+
+func (self *Query) plan(source setop.SetOpSource, trace bool) (result *Plan) {
+	if source.SetOp != nil {
+		result = &Plan{
+			Operation: operationName(source.SetOp.Type),
+		}
+		for _, child := range source.SetOp.Sources {
+			result.Sources = append(result.Sources, self.plan(child, trace))
+		}
+		if trace {
+			start := time.Now()
+			result.Count = self.db.db.SetOpCount(&setop.SetExpression{
+				Op: source.SetOp,
+			})
+			result.Duration = time.Now().Sub(start)
+			result.Traced = true
+		}
+		return
+	}
+	keys := kc.SplitKeys(source.Key)
+	result = &Plan{
+		Operation: planKey,
+		Key:       readableKey(source.Key),
+	}
+	if len(keys) > 0 {
+		result.Keyspace = string(keys[0])
+	}
+	if trace {
+		start := time.Now()
+		result.Count = self.db.db.CountCollection(keys)
+		result.Duration = time.Now().Sub(start)
+		result.Traced = true
+	}
+	return
+}
+
+func (self *Query) explain(obj interface{}, trace bool) (result *Plan, err error) {
+	var value reflect.Value
+	if value, _, err = identify(obj); err != nil {
+		return
+	}
+	self.typ = value.Type()
+	var op *setop.SetOp
+	if op, err = self.setOp(); err != nil {
+		return
+	}
+	result = self.plan(setop.SetOpSource{SetOp: op}, trace)
+	result.Filtered = self.filtered
+	switch {
+	case self.rankBy != nil:
+		result.Order = fmt.Sprintf("relevance for %v in %v", self.rankBy.Text, readableKey(kc.JoinKeys(kc.Keyify(fulltextIndex, typeName(self.typ), self.rankBy.Field))))
+	case self.orderBy != "":
+		direction := "ascending"
+		if self.descending {
+			direction = "descending"
+		}
+		result.Order = fmt.Sprintf("%v %v in %v", self.orderBy, direction, readableKey(kc.JoinKeys(kc.Keyify(secondaryIndex, typeName(self.typ), self.orderBy))))
+	default:
+		result.Order = idField
+	}
+	if trace {
+		start := time.Now()
+		if err = self.each(func(elementPointer reflect.Value) bool {
+			return false
+		}); err != nil {
+			return
+		}
+		result.Elapsed = time.Now().Sub(start)
+		result.Matches = self.found
+	}
+	return
+}
+
+/*
+Explain will return the Plan this query uses to find matches among objects of the same type as obj.
+
+Obj must be a pointer to a struct having a []byte Id field.
+*/
+func (self *Query) Explain(obj interface{}) (result *Plan, err error) {
+	return self.explain(obj, false)
+}
+
+/*
+Trace will return the Plan this query uses to find matches among objects of the same type as obj, after
+measuring the number of keys produced by, and the duration of, each part of it, and running the whole query.
+
+The parts are measured by executing each of them separately, so their numbers are estimates of their shares of the
+query, which is measured by Matches and Elapsed of the root of the Plan.
+
+Obj must be a pointer to a struct having a []byte Id field.
+*/
+func (self *Query) Trace(obj interface{}) (result *Plan, err error) {
+	return self.explain(obj, true)
+}
@@ -0,0 +1,159 @@
+package kol
+
+import (
+	"fmt"
+	"reflect"
+	"strings"
+	"sync"
+)
+
+// taggedField is a field with a kol tag, possibly inside embedded or nested structs.
+type taggedField struct {
+	path   string
+	typ    reflect.Type
+	tag    string
+	params []string
+}
+
+var taggedFieldsMutex = new(sync.RWMutex)
+var taggedFieldsByType = make(map[reflect.Type][]taggedField)
+
+/*
+taggedFields returns the fields of typ having kol tags, including the fields of embedded and nested structs.
+
+Fields of embedded structs are named like promoted fields, and fields of nested structs by dotted paths like Address.City.
+*/
+func taggedFields(typ reflect.Type) (result []taggedField) {
+	taggedFieldsMutex.RLock()
+	result, found := taggedFieldsByType[typ]
+	taggedFieldsMutex.RUnlock()
+	if found {
+		return
+	}
+	result = appendTaggedFields(nil, typ, "", make(map[reflect.Type]bool))
+	taggedFieldsMutex.Lock()
+	defer taggedFieldsMutex.Unlock()
+	taggedFieldsByType[typ] = result
+	return
+}
+
+func appendTaggedFields(result []taggedField, typ reflect.Type, prefix string, visiting map[reflect.Type]bool) []taggedField {
+	visiting[typ] = true
+	defer delete(visiting, typ)
+	for i := 0; i < typ.NumField(); i++ {
+		field := typ.Field(i)
+		if kolTag := field.Tag.Get(kol); kolTag != "" {
+			result = append(result, taggedField{
+				path:   prefix + field.Name,
+				typ:    field.Type,
+				tag:    kolTag,
+				params: strings.Split(kolTag, ","),
+			})
+		}
+		fieldType := field.Type
+		for fieldType.Kind() == reflect.Ptr {
+			fieldType = fieldType.Elem()
+		}
+		// Don't recurse into times, or into types containing themselves
+		if fieldType.Kind() == reflect.Struct && fieldType != timeType && !visiting[fieldType] {
+			if field.Anonymous {
+				result = appendTaggedFields(result, fieldType, prefix, visiting)
+			} else {
+				result = appendTaggedFields(result, fieldType, prefix+field.Name+".", visiting)
+			}
+		}
+	}
+	return result
+}
+
+/*
+fieldByPath returns the field of value named by path, which is either the name of a (possibly promoted) field,
+or a dotted path through nested structs.
+
+If a pointer along the path is nil, result is the zero Value.
+*/
+func fieldByPath(value reflect.Value, path string) (result reflect.Value, err error) {
+	result = value
+	for _, name := range strings.Split(path, ".") {
+		if result = indirect(result); !result.IsValid() {
+			return
+		}
+		if result.Kind() != reflect.Struct {
+			err = fmt.Errorf("%v does not have a field named %v", value.Type(), path)
+			return
+		}
+		field, found := result.Type().FieldByName(name)
+		if !found {
+			err = fmt.Errorf("%v does not have a field named %v", value.Type(), path)
+			return
+		}
+		for _, index := range field.Index {
+			if result = indirect(result); !result.IsValid() {
+				return
+			}
+			result = result.Field(index)
+		}
+	}
+	return
+}
+
+// indirect follows the pointers of value, and returns the zero Value if any of them is nil.
+func indirect(value reflect.Value) reflect.Value {
+	for value.Kind() == reflect.Ptr {
+		if value.IsNil() {
+			return reflect.Value{}
+		}
+		value = value.Elem()
+	}
+	return value
+}
+
+// nillablePath returns whether the field with path in typ can be inside a nil struct pointer.
+func nillablePath(typ reflect.Type, path string) bool {
+	current := typ
+	for i, name := range strings.Split(path, ".") {
+		if i > 0 && current.Kind() == reflect.Ptr {
+			return true
+		}
+		for current.Kind() == reflect.Ptr {
+			current = current.Elem()
+		}
+		if current.Kind() != reflect.Struct {
+			return false
+		}
+		field, found := current.FieldByName(name)
+		if !found {
+			return false
+		}
+		// Embedded structs on the way to promoted fields
+		for _, index := range field.Index[:len(field.Index)-1] {
+			embedded := current.Field(index).Type
+			if embedded.Kind() == reflect.Ptr {
+				return true
+			}
+			current = embedded
+		}
+		current = field.Type
+	}
+	return false
+}
+
+// fieldTypeByPath returns the type of the field of typ named by path, as understood by fieldByPath.
+func fieldTypeByPath(typ reflect.Type, path string) (result reflect.Type, found bool) {
+	result = typ
+	for _, name := range strings.Split(path, ".") {
+		for result.Kind() == reflect.Ptr {
+			result = result.Elem()
+		}
+		if result.Kind() != reflect.Struct {
+			found = false
+			return
+		}
+		var field reflect.StructField
+		if field, found = result.FieldByName(name); !found {
+			return
+		}
+		result = field.Type
+	}
+	return
+}
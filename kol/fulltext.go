@@ -0,0 +1,365 @@
+package kol
+
+import (
+	"encoding/binary"
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"unicode"
+
+	"github.com/zond/kcwraps/kc"
+	"github.com/zond/setop"
+)
+
+const (
+	fulltext      = "fulltext"
+	fulltextIndex = "ft"
+)
+
+/*
+Analyzer turns the text of fields tagged kol:"fulltext", and the text of Match filters, into terms.
+
+Terms may be repeated, since the number of times a term occurs in a field is used to rank matches.
+*/
+type Analyzer interface {
+	Terms(text string) []string
+}
+
+/*
+TextAnalyzer is an Analyzer that lowercases text and splits it into words of unicode letters and numbers.
+
+Words in StopWords are dropped, and the remaining words are replaced with the result of Stem, if it is not nil.
+*/
+type TextAnalyzer struct {
+	StopWords map[string]bool
+	Stem      func(word string) string
+}
+
+func (self TextAnalyzer) Terms(text string) (result []string) {
+	for _, word := range strings.FieldsFunc(strings.ToLower(text), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsNumber(r)
+	}) {
+		if self.StopWords[word] {
+			continue
+		}
+		if self.Stem != nil {
+			word = self.Stem(word)
+		}
+		result = append(result, word)
+	}
+	return
+}
+
+// EnglishStopWords contains common English words that are usually not worth indexing.
+var EnglishStopWords = map[string]bool{
+	"a": true, "an": true, "and": true, "are": true, "as": true, "at": true, "be": true, "but": true,
+	"by": true, "for": true, "if": true, "in": true, "into": true, "is": true, "it": true, "no": true,
+	"not": true, "of": true, "on": true, "or": true, "such": true, "that": true, "the": true, "their": true,
+	"then": true, "there": true, "these": true, "they": true, "this": true, "to": true, "was": true, "will": true,
+	"with": true,
+}
+
+// EnglishStem is a simple stemmer removing common English inflection suffixes.
+func EnglishStem(word string) string {
+	for _, suffix := range []struct {
+		from string
+		to   string
+	}{
+		{"ies", "y"},
+		{"ing", ""},
+		{"ed", ""},
+		{"ly", ""},
+		{"es", ""},
+		{"s", ""},
+	} {
+		if strings.HasSuffix(word, suffix.from) && len(word)-len(suffix.from) >= 3 && !strings.HasSuffix(word, "ss") {
+			stem := word[:len(word)-len(suffix.from)]
+			if last := stem[len(stem)-1]; suffix.to == "" && last == stem[len(stem)-2] && !strings.ContainsRune("aeioulsz", rune(last)) {
+				// running -> run
+				stem = stem[:len(stem)-1]
+			}
+			return stem + suffix.to
+		}
+	}
+	return word
+}
+
+// EnglishAnalyzer is a TextAnalyzer dropping EnglishStopWords and stemming with EnglishStem.
+var EnglishAnalyzer Analyzer = TextAnalyzer{
+	StopWords: EnglishStopWords,
+	Stem:      EnglishStem,
+}
+
+type analyzers struct {
+	lock     *sync.RWMutex
+	analyzer Analyzer
+}
+
+func newAnalyzers() *analyzers {
+	return &analyzers{
+		lock:     new(sync.RWMutex),
+		analyzer: TextAnalyzer{},
+	}
+}
+
+/*
+SetAnalyzer will make analyzer create the terms of all full-text indices and Match filters.
+
+The default Analyzer is a TextAnalyzer without stop words or stemming. Records saved before the Analyzer
+was changed must be reindexed to be found using the new Analyzer.
+*/
+func (self *DB) SetAnalyzer(analyzer Analyzer) {
+	self.analyzers.lock.Lock()
+	defer self.analyzers.lock.Unlock()
+	self.analyzers.analyzer = analyzer
+}
+
+func (self *DB) terms(text string) []string {
+	self.analyzers.lock.RLock()
+	defer self.analyzers.lock.RUnlock()
+	return self.analyzers.analyzer.Terms(text)
+}
+
+// isFulltext returns whether typ has a full-text index for fieldName.
+func isFulltext(typ reflect.Type, fieldName string) bool {
+	for _, field := range taggedFields(typ) {
+		for _, param := range field.params {
+			if param == fulltext && field.path == fieldName {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// fieldText returns the text of a string or []string field.
+func fieldText(typ reflect.Type, value reflect.Value) (result string, err error) {
+	switch {
+	case typ.Kind() == reflect.String:
+		result = value.String()
+	case typ.Kind() == reflect.Slice && typ.Elem().Kind() == reflect.String:
+		parts := make([]string, value.Len())
+		for i := range parts {
+			parts[i] = value.Index(i).String()
+		}
+		result = strings.Join(parts, " ")
+	default:
+		err = fmt.Errorf("%v is not a string or []string, and can not be full-text indexed", typ)
+	}
+	return
+}
+
+// termFrequencies returns the number of times each term occurs in the text of field.
+func (self *DB) termFrequencies(typ reflect.Type, value reflect.Value) (result map[string]uint64, err error) {
+	var text string
+	if text, err = fieldText(typ, value); err != nil {
+		return
+	}
+	result = make(map[string]uint64)
+	for _, term := range self.terms(text) {
+		result[term]++
+	}
+	return
+}
+
+// textIndexKeys returns the full-text index entries of value, mapped to the frequencies of their terms.
+func (self *DB) textIndexKeys(id []byte, value reflect.Value, typ reflect.Type) (indexed map[string]uint64, err error) {
+	indexed = make(map[string]uint64)
+	for _, field := range taggedFields(typ) {
+		for _, param := range field.params {
+			if param != fulltext {
+				continue
+			}
+			var fieldValue reflect.Value
+			if fieldValue, err = fieldByPath(value, field.path); err != nil {
+				return
+			}
+			if !fieldValue.IsValid() {
+				// Inside a nil struct pointer
+				continue
+			}
+			var frequencies map[string]uint64
+			if frequencies, err = self.termFrequencies(field.typ, fieldValue); err != nil {
+				return
+			}
+			for term, frequency := range frequencies {
+				indexed[string(kc.JoinKeys([][]byte{
+					[]byte(fulltextIndex),
+					[]byte(typeName(typ)),
+					[]byte(field.path),
+					[]byte(term),
+					id,
+				}))] = frequency
+			}
+		}
+	}
+	return
+}
+
+func (self *DB) textIndex(id []byte, value reflect.Value, typ reflect.Type) (err error) {
+	var indexed map[string]uint64
+	if indexed, err = self.textIndexKeys(id, value, typ); err != nil {
+		return
+	}
+	for key, frequency := range indexed {
+		if err = self.db.Set(kc.SplitKeys([]byte(key)), uint64Bytes(frequency)); err != nil {
+			return
+		}
+	}
+	return
+}
+
+func (self *DB) deTextIndex(id []byte, value reflect.Value, typ reflect.Type) (err error) {
+	var indexed map[string]uint64
+	if indexed, err = self.textIndexKeys(id, value, typ); err != nil {
+		return
+	}
+	for key, _ := range indexed {
+		// The entry may be missing if the Analyzer has changed since the record was indexed
+		if err = self.db.Remove(kc.SplitKeys([]byte(key))); err != nil && err.Error() != kc.NoRecord {
+			return
+		}
+		err = nil
+	}
+	return
+}
+
+// reTextIndex replaces the full-text index entries of oldValue with those of newValue, only touching the entries that differ.
+func (self *DB) reTextIndex(id []byte, oldValue, newValue reflect.Value, typ reflect.Type) (err error) {
+	var oldIndexed, newIndexed map[string]uint64
+	if oldIndexed, err = self.textIndexKeys(id, oldValue, typ); err != nil {
+		return
+	}
+	if newIndexed, err = self.textIndexKeys(id, newValue, typ); err != nil {
+		return
+	}
+	for key, _ := range oldIndexed {
+		if _, found := newIndexed[key]; !found {
+			if err = self.db.Remove(kc.SplitKeys([]byte(key))); err != nil && err.Error() != kc.NoRecord {
+				return
+			}
+			err = nil
+		}
+	}
+	for key, frequency := range newIndexed {
+		if oldFrequency, found := oldIndexed[key]; !found || oldFrequency != frequency {
+			if err = self.db.Set(kc.SplitKeys([]byte(key)), uint64Bytes(frequency)); err != nil {
+				return
+			}
+		}
+	}
+	return
+}
+
+/*
+Match is a QFilter that matches records where the field tagged kol:"fulltext" contains all terms of Text.
+
+Use Query.RankBy to order the matches by relevance.
+*/
+type Match struct {
+	Field string
+	Text  string
+}
+
+func (self Match) uniqueTerms(db *DB) (result []string) {
+	seen := make(map[string]bool)
+	for _, term := range db.terms(self.Text) {
+		if !seen[term] {
+			result = append(result, term)
+			seen[term] = true
+		}
+	}
+	return
+}
+
+func (self Match) source(db *DB, typ reflect.Type) (result setop.SetOpSource, err error) {
+	if !isFulltext(typ, self.Field) {
+		err = fmt.Errorf("%v.%v is not tagged fulltext, use Query.Scan to allow matching it by scanning all records", typeName(typ), self.Field)
+		return
+	}
+	terms := self.uniqueTerms(db)
+	if len(terms) == 0 {
+		result = emptySource(typ)
+		return
+	}
+	op := setop.SetOp{
+		Merge: setop.First,
+		Type:  setop.Intersection,
+	}
+	for _, term := range terms {
+		op.Sources = append(op.Sources, setop.SetOpSource{
+			Key: kc.JoinKeys([][]byte{[]byte(fulltextIndex), []byte(typeName(typ)), []byte(self.Field), []byte(term)}),
+		})
+	}
+	if len(op.Sources) == 1 {
+		result = op.Sources[0]
+		return
+	}
+	result.SetOp = &op
+	return
+}
+
+func (self Match) match(db *DB, typ reflect.Type, value reflect.Value) (result bool, err error) {
+	var field reflect.Value
+	if field, err = fieldByPath(value, self.Field); err != nil || !field.IsValid() {
+		return
+	}
+	var frequencies map[string]uint64
+	if frequencies, err = db.termFrequencies(field.Type(), field); err != nil {
+		return
+	}
+	terms := self.uniqueTerms(db)
+	for _, term := range terms {
+		if frequencies[term] == 0 {
+			return
+		}
+	}
+	result = len(terms) > 0
+	return
+}
+
+// score returns the sum of the frequencies in the record with id of the terms of self.
+func (self Match) score(db *DB, typ reflect.Type, id []byte) (result uint64, err error) {
+	for _, term := range self.uniqueTerms(db) {
+		var b []byte
+		if b, err = db.db.Get(kc.Keyify(fulltextIndex, typeName(typ), self.Field, term, id)); err != nil {
+			if err.Error() != kc.NoRecord {
+				return
+			}
+			err = nil
+			continue
+		}
+		result += binary.BigEndian.Uint64(b)
+	}
+	return
+}
+
+// ranked is a record found by a query, and its position when ordered by relevance.
+type ranked struct {
+	position [][]byte
+	value    []byte
+}
+
+/*
+rank returns kvs ordered by descending relevance for self.rankBy, and then by Id.
+
+The position of each record is its inverted score followed by its Id, so that positions are ordered like the result.
+*/
+func (self *Query) rank(kvs []kc.KV) (result []ranked, err error) {
+	for _, kv := range kvs {
+		var score uint64
+		if score, err = self.rankBy.score(self.db, self.typ, kv.Keys[0]); err != nil {
+			return
+		}
+		result = append(result, ranked{
+			position: [][]byte{uint64Bytes(^score), kv.Keys[0]},
+			value:    kv.Value,
+		})
+	}
+	sort.Slice(result, func(i, j int) bool {
+		return string(kc.JoinKeys(result[i].position)) < string(kc.JoinKeys(result[j].position))
+	})
+	return
+}
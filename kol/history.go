@@ -0,0 +1,208 @@
+package kol
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"reflect"
+	"sync"
+	"time"
+
+	"github.com/zond/kcwraps/kc"
+)
+
+const (
+	history = "hi"
+)
+
+// Revision describes a change of an object with history kept by KeepHistory.
+type Revision struct {
+	// At is the time of the change.
+	At time.Time
+	// Principal is the principal of the DB making the change, see DB.As.
+	Principal string
+	// Deleted is true if the change deleted the object.
+	Deleted bool
+}
+
+// revision is the stored form of a Revision, with the encoded object before the change, or nil if it didn't exist.
+type revision struct {
+	Principal string
+	Deleted   bool
+	Data      []byte
+}
+
+type histories struct {
+	lock  *sync.RWMutex
+	types map[reflect.Type]bool
+}
+
+func newHistories() *histories {
+	return &histories{
+		lock:  new(sync.RWMutex),
+		types: make(map[reflect.Type]bool),
+	}
+}
+
+/*
+KeepHistory will make all changes of objects of the same type as obj store a Revision with a copy of the object before
+the change, in the same transaction as the change.
+
+Obj must be a pointer to a struct having a []byte Id field.
+*/
+func (self *DB) KeepHistory(obj interface{}) (err error) {
+	var value reflect.Value
+	if value, _, err = identify(obj); err != nil {
+		return
+	}
+	self.histories.lock.Lock()
+	defer self.histories.lock.Unlock()
+	self.histories.types[value.Type()] = true
+	return
+}
+
+func (self *DB) keepsHistory(typ reflect.Type) bool {
+	self.histories.lock.RLock()
+	defer self.histories.lock.RUnlock()
+	return self.histories.types[typ]
+}
+
+/*
+As will return a copy of this DB that records principal as the Principal of the Revisions it stores.
+*/
+func (self DB) As(principal string) *DB {
+	self.principal = principal
+	return &self
+}
+
+/*
+remember stores a Revision of the object with id if typ keeps history, with a copy of the stored object, so it must be
+called before the object is changed.
+*/
+func (self *DB) remember(id []byte, typ reflect.Type, deleted bool) (err error) {
+	if !self.keepsHistory(typ) {
+		return
+	}
+	rev := revision{
+		Principal: self.principal,
+		Deleted:   deleted,
+	}
+	if rev.Data, err = self.db.Get(kc.Keyify(primaryKey, typeName(typ), id)); err != nil {
+		if err.Error() != kc.NoRecord {
+			return
+		}
+		rev.Data, err = nil, nil
+	}
+	var b []byte
+	if b, err = json.Marshal(rev); err != nil {
+		return
+	}
+	at := time.Now().UnixNano()
+	for {
+		keys := kc.Keyify(history, typeName(typ), id, uint64Bytes(uint64(at)))
+		if _, err = self.db.Get(keys); err != nil {
+			if err.Error() != kc.NoRecord {
+				return
+			}
+			return self.db.Set(keys, b)
+		}
+		// Keep the Revisions of changes in the same nanosecond in order
+		at++
+	}
+}
+
+// revisions returns the stored Revisions of the object with id, in order of time.
+func (self *DB) revisions(id []byte, typ reflect.Type) (result []Revision, data [][]byte, err error) {
+	keys := kc.Keyify(history, typeName(typ), id)
+	for _, kv := range self.db.GetCollection(keys) {
+		var rev revision
+		if err = json.Unmarshal(kv.Value, &rev); err != nil {
+			return
+		}
+		result = append(result, Revision{
+			At:        time.Unix(0, int64(binary.BigEndian.Uint64(kv.Keys[len(keys)]))),
+			Principal: rev.Principal,
+			Deleted:   rev.Deleted,
+		})
+		data = append(data, rev.Data)
+	}
+	return
+}
+
+/*
+Revisions will return the Revisions of the object with the Id of obj, in order of time.
+
+Obj must be a pointer to a struct having a []byte Id field.
+*/
+func (self *DB) Revisions(obj interface{}) (result []Revision, err error) {
+	var value, id reflect.Value
+	if value, id, err = identify(obj); err != nil {
+		return
+	}
+	result, _, err = self.revisions(id.Bytes(), value.Type())
+	return
+}
+
+/*
+GetAt will load the object with the Id of obj as it was at the given time into obj.
+
+Obj must be a pointer to a struct having a []byte Id field.
+
+Objects that existed before KeepHistory was called are loaded as they were then for all earlier times.
+
+Returns NotFound if the object didn't exist at the given time.
+*/
+func (self *DB) GetAt(obj interface{}, at time.Time) (err error) {
+	var value, id reflect.Value
+	if value, id, err = identify(obj); err != nil {
+		return
+	}
+	var revisions []Revision
+	var data [][]byte
+	if revisions, data, err = self.revisions(id.Bytes(), value.Type()); err != nil {
+		return
+	}
+	for index, rev := range revisions {
+		if rev.At.After(at) {
+			// The first change after the given time has the object as it was
+			if data[index] == nil {
+				return NotFound
+			}
+			return self.decode(data[index], obj)
+		}
+	}
+	return self.get(id.Bytes(), value, obj)
+}
+
+/*
+Revert will Set the object with the Id of obj to how it was at the given time, and load the result into obj.
+
+Obj must be a pointer to a struct having a []byte Id field.
+
+Returns NotFound if the object didn't exist at the given time.
+*/
+func (self *DB) Revert(obj interface{}, at time.Time) (err error) {
+	var value, id reflect.Value
+	if value, id, err = identify(obj); err != nil {
+		return
+	}
+	typ := value.Type()
+	return self.Transact(func(self *DB) (err error) {
+		if err = self.GetAt(obj, at); err != nil {
+			return
+		}
+		if version, found := versionOf(value); found {
+			// Revert the current version, whatever it is
+			current := reflect.New(typ)
+			if err = self.get(id.Bytes(), current.Elem(), current.Interface()); err == nil {
+				currentVersion, _ := versionOf(current.Elem())
+				setVersion(version, getVersion(currentVersion))
+			} else if err == NotFound {
+				setVersion(version, 0)
+				err = nil
+			} else {
+				return
+			}
+		}
+		return self.Set(obj)
+	})
+}
@@ -0,0 +1,162 @@
+package kol
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/binary"
+	"fmt"
+	"reflect"
+	"sync"
+	"time"
+
+	"github.com/zond/kcwraps/kc"
+)
+
+const (
+	sequenceMeta = "sequence"
+)
+
+// IdGenerator creates the Ids of objects saved without Ids.
+type IdGenerator interface {
+	NewId(db *DB, typ reflect.Type) ([]byte, error)
+}
+
+/*
+RandomIds creates cryptographically unpredictable Ids of Length random bytes, or 24 random bytes if Length is 0.
+
+RandomIds is the default IdGenerator.
+*/
+type RandomIds struct {
+	Length int
+}
+
+func (self RandomIds) NewId(db *DB, typ reflect.Type) (result []byte, err error) {
+	length := self.Length
+	if length == 0 {
+		length = 24
+	}
+	result = make([]byte, length)
+	_, err = rand.Read(result)
+	return
+}
+
+/*
+TimeOrderedIds creates ULID-style Ids of 16 bytes, a 6 byte millisecond timestamp followed by 10 random bytes, so
+that the order of the Ids is the order of their creation.
+
+Ids created in the same millisecond get incremented random bytes instead of new random bytes, to keep their order.
+
+The zero value is ready to use, but must not be copied after first use.
+*/
+type TimeOrderedIds struct {
+	lock sync.Mutex
+	last []byte
+}
+
+// NewTimeOrderedIds returns a new TimeOrderedIds.
+func NewTimeOrderedIds() *TimeOrderedIds {
+	return &TimeOrderedIds{}
+}
+
+func (self *TimeOrderedIds) NewId(db *DB, typ reflect.Type) (result []byte, err error) {
+	timestamp := uint64Bytes(uint64(time.Now().UnixNano() / int64(time.Millisecond)))[2:]
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	result = make([]byte, 16)
+	copy(result, timestamp)
+	if self.last != nil && bytes.Compare(timestamp, self.last[:6]) <= 0 {
+		// The clock didn't move forward, so increment the last Id
+		copy(result, self.last)
+		for i := len(result) - 1; i >= 6; i-- {
+			result[i]++
+			if result[i] != 0 {
+				break
+			}
+			if i == 6 {
+				err = fmt.Errorf("Ran out of time ordered Ids for %v", Id(self.last))
+				return
+			}
+		}
+	} else if _, err = rand.Read(result[6:]); err != nil {
+		return
+	}
+	self.last = result
+	return
+}
+
+/*
+SequenceIds creates Ids that are the 8 byte big endian encodings of sequences starting at 1, separate for each type
+and stored in the database, so that the order of the Ids is the order of their creation.
+*/
+type SequenceIds struct{}
+
+func (self SequenceIds) NewId(db *DB, typ reflect.Type) (result []byte, err error) {
+	var next int64
+	if next, err = db.db.IncrInt(kc.Keyify(meta, typeName(typ), sequenceMeta), 1); err != nil {
+		return
+	}
+	result = uint64Bytes(uint64(next))
+	return
+}
+
+/*
+SequenceId returns the sequence number encoded in an Id created by SequenceIds.
+*/
+func SequenceId(id []byte) (result uint64, err error) {
+	if len(id) != 8 {
+		err = fmt.Errorf("%v is not a sequence Id", Id(id))
+		return
+	}
+	result = binary.BigEndian.Uint64(id)
+	return
+}
+
+type idGenerators struct {
+	lock      *sync.RWMutex
+	generator IdGenerator
+	types     map[reflect.Type]IdGenerator
+}
+
+func newIdGenerators() *idGenerators {
+	return &idGenerators{
+		lock:      new(sync.RWMutex),
+		generator: RandomIds{},
+		types:     make(map[reflect.Type]IdGenerator),
+	}
+}
+
+/*
+SetIdGenerator will make generator create the Ids of objects saved without Ids, except for types with their own
+IdGenerators.
+*/
+func (self *DB) SetIdGenerator(generator IdGenerator) {
+	self.idGenerators.lock.Lock()
+	defer self.idGenerators.lock.Unlock()
+	self.idGenerators.generator = generator
+}
+
+/*
+SetTypeIdGenerator will make generator create the Ids of objects of the same type as obj saved without Ids.
+
+Obj must be a pointer to a struct having a []byte Id field.
+*/
+func (self *DB) SetTypeIdGenerator(obj interface{}, generator IdGenerator) (err error) {
+	var value reflect.Value
+	if value, _, err = identify(obj); err != nil {
+		return
+	}
+	self.idGenerators.lock.Lock()
+	defer self.idGenerators.lock.Unlock()
+	self.idGenerators.types[value.Type()] = generator
+	return
+}
+
+func (self *DB) newId(typ reflect.Type) ([]byte, error) {
+	self.idGenerators.lock.RLock()
+	generator, found := self.idGenerators.types[typ]
+	if !found {
+		generator = self.idGenerators.generator
+	}
+	self.idGenerators.lock.RUnlock()
+	return generator.NewId(self, typ)
+}
@@ -1,32 +1,65 @@
 package kol
 
 import (
-	"bytes"
 	"encoding/binary"
 	"fmt"
+	"math"
 	"reflect"
 	"regexp"
-	"strings"
+	"time"
+
+	"github.com/zond/kcwraps/kc"
 )
 
 const (
 	index          = "index"
 	secondaryIndex = "2i"
 	foreignIndex   = "fi"
+	// nilIndex contains the records with indexed fields inside nil struct pointers, which have no secondary index entries.
+	nilIndex = "ni"
 )
 
 var fkPattern = regexp.MustCompile("fk<([^>]+)>")
 
+func uint64Bytes(i uint64) (b []byte) {
+	b = make([]byte, 8)
+	binary.BigEndian.PutUint64(b, i)
+	return
+}
+
+/*
+indexBytes encodes value so that the byte order of the encoded values equals the order of the values.
+
+Signed integers get their sign bit flipped, floats get their sign bit flipped if positive and all bits flipped
+if negative, and times are encoded as signed seconds followed by nanoseconds.
+*/
 func indexBytes(typ reflect.Type, value reflect.Value) (b []byte, err error) {
+	if typ == timeType {
+		t := value.Interface().(time.Time)
+		b = append(uint64Bytes(uint64(t.Unix())^(1<<63)), 0, 0, 0, 0)
+		binary.BigEndian.PutUint32(b[8:], uint32(t.Nanosecond()))
+		return
+	}
 	switch typ.Kind() {
 	case reflect.String:
 		b = []byte(value.String())
-	case reflect.Int:
-		buf := new(bytes.Buffer)
-		if err = binary.Write(buf, binary.BigEndian, value.Int()); err != nil {
-			return
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		b = uint64Bytes(uint64(value.Int()) ^ (1 << 63))
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		b = uint64Bytes(value.Uint())
+	case reflect.Float32, reflect.Float64:
+		f := value.Float()
+		if f == 0 {
+			// Make -0 and +0 equal
+			f = 0
+		}
+		bits := math.Float64bits(f)
+		if bits&(1<<63) == 0 {
+			bits ^= 1 << 63
+		} else {
+			bits = ^bits
 		}
-		b = buf.Bytes()
+		b = uint64Bytes(bits)
 	case reflect.Slice:
 		switch typ.Elem().Kind() {
 		case reflect.Uint8:
@@ -46,17 +79,99 @@ func indexBytes(typ reflect.Type, value reflect.Value) (b []byte, err error) {
 	return
 }
 
-func indexKey(id []byte, typ reflect.Type, fieldName string, fieldType reflect.Type, fieldValue reflect.Value) (keys [][]byte, err error) {
-	var valuePart []byte
-	if valuePart, err = indexBytes(fieldType, fieldValue); err != nil {
+/*
+filterBytes encodes the value of a filter for the field named fieldName in typ, after converting it to the type
+of the field (or of its elements, if it is multi valued) if possible so that for example untyped integer constants
+match unsigned fields.
+
+Returns an error if the value can't be converted to the type of the field without changing it, like negative numbers
+for unsigned fields or fractions for integer fields.
+*/
+func filterBytes(typ reflect.Type, fieldName string, filterValue interface{}) (b []byte, err error) {
+	value := reflect.ValueOf(filterValue)
+	if !value.IsValid() {
+		err = fmt.Errorf("Can't filter %v on nil", fieldName)
 		return
 	}
-	keys = [][]byte{
-		[]byte(secondaryIndex),
-		[]byte(typ.Name()),
-		[]byte(fieldName),
-		valuePart,
-		id,
+	if fieldType, found := fieldTypeByPath(typ, fieldName); found {
+		if multiValued(fieldType) {
+			// Filters on multi valued fields are compared to the elements
+			fieldType = fieldType.Elem()
+		}
+		if value.Type() != fieldType {
+			if isNumeric(value.Kind()) && isNumeric(fieldType.Kind()) {
+				converted := value.Convert(fieldType)
+				if !isFloat(fieldType.Kind()) && converted.Convert(value.Type()).Interface() != value.Interface() {
+					err = fmt.Errorf("Can't filter %v on %v, it would be changed to %v", fieldName, filterValue, converted.Interface())
+					return
+				}
+				value = converted
+			} else if value.Kind() == reflect.String && fieldType.Kind() == reflect.String {
+				value = value.Convert(fieldType)
+			}
+		}
+	}
+	return indexBytes(value.Type(), value)
+}
+
+func isNumeric(kind reflect.Kind) bool {
+	switch kind {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return true
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		return true
+	case reflect.Float32, reflect.Float64:
+		return true
+	}
+	return false
+}
+
+func isFloat(kind reflect.Kind) bool {
+	return kind == reflect.Float32 || kind == reflect.Float64
+}
+
+// multiValued returns whether fields of typ are indexed with one entry per element.
+func multiValued(typ reflect.Type) bool {
+	return (typ.Kind() == reflect.Slice || typ.Kind() == reflect.Array) && typ.Elem().Kind() != reflect.Uint8
+}
+
+// valueBytes returns the distinct encoded elements of value if typ is multi valued, or the encoded value otherwise.
+func valueBytes(typ reflect.Type, value reflect.Value) (result [][]byte, err error) {
+	if !multiValued(typ) {
+		var b []byte
+		if b, err = indexBytes(typ, value); err != nil {
+			return
+		}
+		result = [][]byte{b}
+		return
+	}
+	seen := make(map[string]bool)
+	for i := 0; i < value.Len(); i++ {
+		var b []byte
+		if b, err = indexBytes(typ.Elem(), value.Index(i)); err != nil {
+			return
+		}
+		if !seen[string(b)] {
+			result = append(result, b)
+			seen[string(b)] = true
+		}
+	}
+	return
+}
+
+func indexKey(id []byte, typ reflect.Type, fieldName string, fieldType reflect.Type, fieldValue reflect.Value) (indexed [][][]byte, err error) {
+	var valueParts [][]byte
+	if valueParts, err = valueBytes(fieldType, fieldValue); err != nil {
+		return
+	}
+	for _, valuePart := range valueParts {
+		indexed = append(indexed, [][]byte{
+			[]byte(secondaryIndex),
+			[]byte(typeName(typ)),
+			[]byte(fieldName),
+			valuePart,
+			id,
+		})
 	}
 	return
 }
@@ -76,7 +191,7 @@ func foreignKey(
 	}
 	keys = [][]byte{
 		[]byte(foreignIndex),
-		[]byte(typ.Name()),
+		[]byte(typeName(typ)),
 		[]byte(foreignFieldName),
 		[]byte(idFieldName),
 		foreignPart,
@@ -86,64 +201,115 @@ func foreignKey(
 	return
 }
 
+// isIndexed returns whether typ has a secondary index for fieldName.
+func isIndexed(typ reflect.Type, fieldName string) bool {
+	for _, field := range taggedFields(typ) {
+		for _, param := range field.params {
+			if (param == index || param == unique) && field.path == fieldName {
+				return true
+			}
+			if match := fkPattern.FindStringSubmatch(param); match != nil && match[1] == fieldName {
+				return true
+			}
+		}
+	}
+	return false
+}
+
 func indexKeys(id []byte, value reflect.Value, typ reflect.Type) (indexed [][][]byte, err error) {
 	alreadyIndexed := make(map[string]bool)
-	for i := 0; i < typ.NumField(); i++ {
-		field := typ.Field(i)
-		if kolTag := field.Tag.Get(kol); kolTag != "" {
-			for _, param := range strings.Split(kolTag, ",") {
-				if param == index {
-					// kol:"index"
-					if !alreadyIndexed[field.Name] {
-						// Not already indexed
+	for _, field := range taggedFields(typ) {
+		var fieldValue reflect.Value
+		if fieldValue, err = fieldByPath(value, field.path); err != nil {
+			return
+		}
+		if !fieldValue.IsValid() {
+			// Inside a nil struct pointer, so only recorded as missing to let OrderBy find it
+			for _, param := range field.params {
+				if param == index || param == unique {
+					indexed = append(indexed, [][]byte{
+						[]byte(nilIndex),
+						[]byte(typeName(typ)),
+						[]byte(field.path),
+						id,
+					})
+					break
+				}
+			}
+			continue
+		}
+		for _, param := range field.params {
+			if param == index || param == unique {
+				// kol:"index" or kol:"unique"
+				if !alreadyIndexed[field.path] {
+					// Not already indexed
+					var keys [][][]byte
+					// Build the index keys
+					keys, err = indexKey(id, typ, field.path, field.typ, fieldValue)
+					if err != nil {
+						return
+					}
+					indexed = append(indexed, keys...)
+					alreadyIndexed[field.path] = true
+				}
+			} else if match := fkPattern.FindStringSubmatch(param); match != nil {
+				// Wants it treated as foreign key
+				if field.typ.Kind() == reflect.Slice && field.typ.Elem().Kind() == reflect.Uint8 {
+					// Is a []byte
+					if matchFieldType, found := fieldTypeByPath(typ, match[1]); found {
+						// And the match field exists
+						var matchField reflect.Value
+						if matchField, err = fieldByPath(value, match[1]); err != nil {
+							return
+						}
+						if !matchField.IsValid() {
+							// Inside a nil struct pointer
+							continue
+						}
 						var keys [][]byte
-						// Build an index key
-						keys, err = indexKey(id, typ, field.Name, field.Type, value.Field(i))
+						// Build a foreign key
+						keys, err = foreignKey(id, fieldValue.Bytes(), typ, match[1], field.path, matchFieldType, matchField)
 						if err != nil {
 							return
 						}
 						indexed = append(indexed, keys)
-						alreadyIndexed[field.Name] = true
-					}
-				} else if match := fkPattern.FindStringSubmatch(param); match != nil {
-					// Wants it treated as foreign key
-					if field.Type.Kind() == reflect.Slice && field.Type.Elem().Kind() == reflect.Uint8 {
-						// Is a []byte
-						if matchField := value.FieldByName(match[1]); matchField.IsValid() {
-							// And the match field exists
-							matchFieldType := matchField.Type()
-							var keys [][]byte
-							// Build a foreign key
-							keys, err = foreignKey(id, value.Field(i).Bytes(), typ, match[1], field.Name, matchFieldType, matchField)
+						if !alreadyIndexed[match[1]] {
+							// The match key is not already indexed, build the index keys
+							var matchKeys [][][]byte
+							matchKeys, err = indexKey(id, typ, match[1], matchFieldType, matchField)
 							if err != nil {
 								return
 							}
-							indexed = append(indexed, keys)
-							if !alreadyIndexed[match[1]] {
-								// The match key is not already indexed, build an index key
-								keys, err = indexKey(id, typ, match[1], matchFieldType, matchField)
-								if err != nil {
-									return
-								}
-								indexed = append(indexed, keys)
-								alreadyIndexed[match[1]] = true
-							}
-						} else {
-							err = fmt.Errorf("%v.%v is tagged as %v, but there is no field named %v", typ.Name, field.Name, kolTag, match[1])
-							return
+							indexed = append(indexed, matchKeys...)
+							alreadyIndexed[match[1]] = true
 						}
 					} else {
-						err = fmt.Errorf("%v.%v is  tagged as %v, but it is not a []byte", typ.Name, field.Name, kolTag)
+						err = fmt.Errorf("%v.%v is tagged as %v, but there is no field named %v", typeName(typ), field.path, field.tag, match[1])
 						return
 					}
+				} else {
+					err = fmt.Errorf("%v.%v is  tagged as %v, but it is not a []byte", typeName(typ), field.path, field.tag)
+					return
 				}
 			}
 		}
 	}
+	for _, c := range composites(typ) {
+		var keys [][]byte
+		if keys, err = compositeKey(id, value, typ, c); err != nil {
+			return
+		}
+		if keys != nil {
+			indexed = append(indexed, keys)
+		}
+	}
 	return
 }
 
 func (self *DB) index(id []byte, value reflect.Value, typ reflect.Type) (err error) {
+	if err = self.unique(id, value, typ); err != nil {
+		return
+	}
 	var indexed [][][]byte
 	if indexed, err = indexKeys(id, value, typ); err != nil {
 		return
@@ -153,18 +319,83 @@ func (self *DB) index(id []byte, value reflect.Value, typ reflect.Type) (err err
 			return
 		}
 	}
-	return
+	if err = self.textIndex(id, value, typ); err != nil {
+		return
+	}
+	return self.markDeleted(id, value, typ)
 }
 
+/*
+deIndex removes the index entries of value.
+
+Entries that are missing, because they were written in an older index format or a Reindex didn't finish, are ignored,
+so that the records can still be changed until they are reindexed.
+*/
 func (self *DB) deIndex(id []byte, value reflect.Value, typ reflect.Type) (err error) {
+	if err = self.deUnique(value, typ); err != nil {
+		return
+	}
 	var indexed [][][]byte
 	if indexed, err = indexKeys(id, value, typ); err != nil {
 		return
 	}
 	for _, keys := range indexed {
-		if err = self.db.Remove(keys); err != nil {
+		if err = self.db.Remove(keys); err != nil && err.Error() != kc.NoRecord {
+			return
+		}
+		err = nil
+	}
+	if err = self.deTextIndex(id, value, typ); err != nil {
+		return
+	}
+	return self.unmarkDeleted(id, value, typ)
+}
+
+// reIndex replaces the index entries of oldValue with those of newValue, only touching the entries that differ.
+func (self *DB) reIndex(id []byte, oldValue, newValue reflect.Value, typ reflect.Type) (err error) {
+	if err = self.reUnique(id, oldValue, newValue, typ); err != nil {
+		return
+	}
+	var oldIndexed, newIndexed [][][]byte
+	if oldIndexed, err = indexKeys(id, oldValue, typ); err != nil {
+		return
+	}
+	if newIndexed, err = indexKeys(id, newValue, typ); err != nil {
+		return
+	}
+	newKeys := make(map[string]bool)
+	for _, keys := range newIndexed {
+		newKeys[string(kc.JoinKeys(keys))] = true
+	}
+	oldKeys := make(map[string]bool)
+	for _, keys := range oldIndexed {
+		joined := string(kc.JoinKeys(keys))
+		oldKeys[joined] = true
+		if !newKeys[joined] {
+			// Missing entries are ignored like in deIndex
+			if err = self.db.Remove(keys); err != nil && err.Error() != kc.NoRecord {
+				return
+			}
+			err = nil
+		}
+	}
+	for _, keys := range newIndexed {
+		if !oldKeys[string(kc.JoinKeys(keys))] {
+			if err = self.db.Set(keys, []byte{0}); err != nil {
+				return
+			}
+		}
+	}
+	if err = self.reTextIndex(id, oldValue, newValue, typ); err != nil {
+		return
+	}
+	oldDeletedAt, _ := deletedAt(oldValue)
+	newDeletedAt, _ := deletedAt(newValue)
+	if !oldDeletedAt.Equal(newDeletedAt) {
+		if err = self.unmarkDeleted(id, oldValue, typ); err != nil {
 			return
 		}
+		return self.markDeleted(id, newValue, typ)
 	}
 	return
 }
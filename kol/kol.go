@@ -5,7 +5,6 @@ import (
 	"encoding/base64"
 	"encoding/json"
 	"fmt"
-	"math/rand"
 	"reflect"
 	"sync"
 	"time"
@@ -58,18 +57,6 @@ func (self *Id) Equals(o Id) bool {
 // NotFound means that the mentioned key did not exist.
 var NotFound = fmt.Errorf("Not found")
 
-func init() {
-	rand.Seed(time.Now().UnixNano())
-}
-
-func randomBytes() (result []byte) {
-	result = make([]byte, 24)
-	for i, _ := range result {
-		result[i] = byte(rand.Int31())
-	}
-	return
-}
-
 func identify(obj interface{}) (value, id reflect.Value, err error) {
 	ptrValue := reflect.ValueOf(obj)
 	if ptrValue.Kind() != reflect.Ptr {
@@ -104,6 +91,12 @@ type DB struct {
 	db                 *kc.DB
 	subscriptionsMutex *sync.RWMutex
 	subscriptions      map[string]map[string]*Subscription
+	codecs             *codecs
+	analyzers          *analyzers
+	migrations         *migrations
+	histories          *histories
+	idGenerators       *idGenerators
+	principal          string
 }
 
 func (self *DB) String() string {
@@ -129,6 +122,11 @@ func New(path string) (result *DB, err error) {
 		db:                 kcdb,
 		subscriptionsMutex: new(sync.RWMutex),
 		subscriptions:      make(map[string]map[string]*Subscription),
+		codecs:             newCodecs(),
+		analyzers:          newAnalyzers(),
+		migrations:         newMigrations(),
+		histories:          newHistories(),
+		idGenerators:       newIdGenerators(),
 	}
 	return
 }
@@ -186,6 +184,10 @@ func (self DB) Transact(f func(d *DB) error) (err error) {
 Del will delete the obj from the database.
 
 Obj must be a pointer to a struct having a []byte Id field.
+
+If obj has a time.Time DeletedAt field, Del will only soft delete it by setting the field, which excludes it from
+queries not using WithDeleted but keeps its unique values, and returns NotFound if it is already soft deleted.
+Soft deleted objects can be restored using Undelete, and permanently removed using Purge.
 */
 func (self *DB) Del(obj interface{}) (err error) {
 	var value reflect.Value
@@ -194,10 +196,16 @@ func (self *DB) Del(obj interface{}) (err error) {
 		return
 	}
 	typ := value.Type()
+	if softDeletable(typ) {
+		return self.softDel(id.Bytes(), value, typ, obj)
+	}
 	if err = self.Transact(func(self *DB) error {
-		b, err := self.db.Get(kc.Keyify(primaryKey, typ.Name(), id.Bytes()))
+		if err := self.remember(id.Bytes(), typ, true); err != nil {
+			return err
+		}
+		b, err := self.db.Get(kc.Keyify(primaryKey, typeName(typ), id.Bytes()))
 		if err == nil {
-			if err := json.Unmarshal(b, obj); err != nil {
+			if err := self.decode(b, obj); err != nil {
 				return err
 			}
 			if err := self.deIndex(id.Bytes(), value, typ); err != nil {
@@ -206,7 +214,7 @@ func (self *DB) Del(obj interface{}) (err error) {
 		} else if err.Error() != kc.NoRecord {
 			return err
 		}
-		if err := self.db.Remove(kc.Keyify(primaryKey, typ.Name(), id.Bytes())); err != nil {
+		if err := self.db.Remove(kc.Keyify(primaryKey, typeName(typ), id.Bytes())); err != nil {
 			if err.Error() == kc.NoRecord {
 				err = NotFound
 			}
@@ -224,7 +232,7 @@ func (self *DB) Del(obj interface{}) (err error) {
 }
 
 /*
-Get will find the object from the database, and JSON decode it into result.
+Get will find the object from the database, and decode it into result.
 
 Obj must be a pointer to a struct having a []byte Id field.
 */
@@ -237,22 +245,22 @@ func (self *DB) Get(obj interface{}) error {
 }
 
 func (self *DB) get(id []byte, value reflect.Value, obj interface{}) error {
-	b, err := self.db.Get(kc.Keyify(primaryKey, value.Type().Name(), id))
+	b, err := self.db.Get(kc.Keyify(primaryKey, typeName(value.Type()), id))
 	if err != nil {
 		if err.Error() == kc.NoRecord {
 			err = NotFound
 		}
 		return err
 	}
-	return json.Unmarshal(b, obj)
+	return self.decode(b, obj)
 }
 
 func (self *DB) save(id []byte, typ reflect.Type, obj interface{}) error {
-	bytes, err := json.Marshal(obj)
+	bytes, err := self.encode(typ, obj)
 	if err != nil {
 		return err
 	}
-	return self.db.Set(kc.Keyify(primaryKey, typ.Name(), id), bytes)
+	return self.db.Set(kc.Keyify(primaryKey, typeName(typ), id), bytes)
 }
 
 /*
@@ -273,6 +281,9 @@ func (self *DB) Index(obj interface{}) error {
 }
 
 func (self *DB) create(id []byte, value reflect.Value, typ reflect.Type, obj interface{}) (err error) {
+	if version, found := versionOf(value); found {
+		setVersion(version, 1)
+	}
 	if updatedAt := value.FieldByName(updatedAtField); updatedAt.IsValid() && updatedAt.Type() == timeType {
 		updatedAt.Set(reflect.ValueOf(time.Now()))
 	}
@@ -280,11 +291,17 @@ func (self *DB) create(id []byte, value reflect.Value, typ reflect.Type, obj int
 		createdAt.Set(reflect.ValueOf(time.Now()))
 	}
 	if err = self.Transact(func(self *DB) error {
+		if err := self.remember(id, typ, false); err != nil {
+			return err
+		}
 		if err := self.index(id, value, typ); err != nil {
 			return err
 		}
 		return self.save(id, typ, obj)
 	}); err != nil {
+		if version, found := versionOf(value); found {
+			setVersion(version, 0)
+		}
 		return
 	}
 	if err = self.db.BetweenTransactions(func(d *kc.DB) (err error) {
@@ -296,10 +313,16 @@ func (self *DB) create(id []byte, value reflect.Value, typ reflect.Type, obj int
 }
 
 func (self *DB) update(id []byte, oldValue, objValue reflect.Value, typ reflect.Type, obj interface{}) (err error) {
+	if err = checkVersion(oldValue, objValue); err != nil {
+		return
+	}
 	if updatedAt := objValue.FieldByName(updatedAtField); updatedAt.IsValid() && updatedAt.Type() == timeType {
 		updatedAt.Set(reflect.ValueOf(time.Now()))
 	}
 	if err = self.Transact(func(self *DB) (err error) {
+		if err = self.remember(id, typ, false); err != nil {
+			return
+		}
 		if err = self.deIndex(id, oldValue, typ); err != nil {
 			return
 		}
@@ -308,6 +331,10 @@ func (self *DB) update(id []byte, oldValue, objValue reflect.Value, typ reflect.
 		}
 		return self.save(id, typ, obj)
 	}); err != nil {
+		// Let the caller retry with the Version it had
+		if version, found := versionOf(objValue); found {
+			setVersion(version, getVersion(version)-1)
+		}
 		return
 	}
 	if err = self.db.BetweenTransactions(func(d *kc.DB) (err error) {
@@ -319,13 +346,22 @@ func (self *DB) update(id []byte, oldValue, objValue reflect.Value, typ reflect.
 }
 
 /*
-Set will JSON encode obj and insert it into the database
+Set will encode obj using the Codec of its type and insert it into the database
 
 Obj must be a pointer to a struct having a []byte Id field.
 
-If the Id field is empty, a random Id will be chosen.
+If the Id field is empty, an Id will be created by the IdGenerator of its type, by default 24 random bytes.
 
 Any fields tagged `kol:"index"` will be indexed separately, and possible to search for using Query.
+Slice and array fields (except []byte) get one index entry per element.
+Fields of embedded and nested structs can be tagged as well, and fields of nested structs are named by dotted
+paths like Address.City in tags and filters.
+
+Any fields tagged `kol:"unique"`, or groups of fields named by a `kol:"unique<Field1+Field2>"` tag, must not have the
+same values as for any other record of the same type, or Set will return an ErrUniqueViolation.
+
+If obj has an integer Version field, Set will return an ErrConflict unless it is the same as the Version of the stored
+object (or 0 if there is no stored object), and otherwise increment it.
 */
 func (self *DB) Set(obj interface{}) error {
 	value, id, err := identify(obj)
@@ -333,22 +369,25 @@ func (self *DB) Set(obj interface{}) error {
 		return err
 	}
 	if idBytes := id.Bytes(); idBytes == nil {
-		idBytes = randomBytes()
+		if idBytes, err = self.newId(value.Type()); err != nil {
+			return err
+		}
 		id.SetBytes(idBytes)
 		return self.create(idBytes, value, value.Type(), obj)
 	} else {
 		typ := value.Type()
 		old := reflect.New(typ).Interface()
 		oldValue := reflect.ValueOf(old).Elem()
-		var oldValuePtr *reflect.Value
 		return self.Transact(func(self *DB) error {
 			if err := self.get(idBytes, oldValue, old); err == nil {
-				oldValuePtr = &oldValue
 				return self.update(idBytes, oldValue, value, typ, obj)
 			} else {
 				if err != NotFound {
 					return err
 				}
+				if version, found := versionOf(value); found && getVersion(version) != 0 {
+					return ErrConflict{}
+				}
 				return self.create(idBytes, value, value.Type(), obj)
 			}
 		})
@@ -2,14 +2,19 @@ package kol
 
 import (
 	"bytes"
+	"encoding/base64"
+	"encoding/binary"
 	"fmt"
 	"math/rand"
 	"os"
 	"reflect"
 	"runtime/debug"
+	"sort"
 	"strings"
 	"testing"
 	"time"
+
+	"github.com/zond/kcwraps/kc"
 )
 
 type testStruct struct {
@@ -642,3 +647,1940 @@ func TestCreatedAt(t *testing.T) {
 		t.Errorf("Wanted equal")
 	}
 }
+
+type namedStruct struct {
+	Id []byte
+}
+
+func (self namedStruct) KolType() string {
+	return "named"
+}
+
+type migratedStruct struct {
+	Id   []byte
+	Name string `kol:"index"`
+}
+
+func TestTypeNames(t *testing.T) {
+	if name := typeName(reflect.TypeOf(testStruct{})); name != "github.com/zond/kcwraps/kol.testStruct" {
+		t.Errorf("Wrong type name %v", name)
+	}
+	if name := typeName(reflect.TypeOf(namedStruct{})); name != "named" {
+		t.Errorf("Wrong type name %v", name)
+	}
+	d, err := New("test")
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	d.Clear()
+	defer d.Close()
+	defer func() {
+		// Restore the package level registry for the other tests
+		typeNamesMutex.Lock()
+		defer typeNamesMutex.Unlock()
+		delete(typeNames, reflect.TypeOf(migratedStruct{}))
+	}()
+	RegisterType(&migratedStruct{}, "migratedStruct")
+	m := &migratedStruct{Name: "hehu"}
+	if err := d.Set(m); err != nil {
+		t.Fatalf(err.Error())
+	}
+	RegisterType(&migratedStruct{}, "kol.migratedStruct")
+	if err := d.Get(&migratedStruct{Id: m.Id}); err != NotFound {
+		t.Errorf("Wanted NotFound, got %v", err)
+	}
+	if err := d.MigrateTypeName(&migratedStruct{}); err != nil {
+		t.Fatalf(err.Error())
+	}
+	m2 := &migratedStruct{Id: m.Id}
+	if err := d.Get(m2); err != nil || m2.Name != "hehu" {
+		t.Errorf("Wanted %+v, got %+v, %v", m, m2, err)
+	}
+	var res []migratedStruct
+	if err := d.Query().Where(Equals{"Name", "hehu"}).All(&res); err != nil || len(res) != 1 {
+		t.Errorf("Wanted one result, got %+v, %v", res, err)
+	}
+	if count, _ := d.Count(); count != 2 {
+		t.Errorf("Wanted 2 records, got %v", count)
+	}
+}
+
+type codecInner struct {
+	Floats []float64
+}
+
+// codecPoint marshals itself with pointer receivers.
+type codecPoint struct {
+	X, Y int
+}
+
+func (self *codecPoint) MarshalBinary() ([]byte, error) {
+	return []byte(fmt.Sprintf("%v,%v", self.X, self.Y)), nil
+}
+
+func (self *codecPoint) UnmarshalBinary(b []byte) (err error) {
+	_, err = fmt.Sscanf(string(b), "%d,%d", &self.X, &self.Y)
+	return
+}
+
+type codecStruct struct {
+	Id         []byte
+	Name       string `kol:"index"`
+	Big        int64
+	Huge       uint64
+	Small      int8
+	Ratio      float64
+	Tags       []string
+	Counts     map[string]int
+	Inner      *codecInner
+	Missing    *codecInner
+	Bytes      []byte
+	Point      codecPoint
+	CreatedAt  time.Time
+	unexported int
+}
+
+func TestCodecs(t *testing.T) {
+	d, err := New("test")
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	d.Clear()
+	defer d.Close()
+	var ids [][]byte
+	for _, codec := range []Codec{JSONCodec, GobCodec, BinaryCodec} {
+		d.SetCodec(&codecStruct{}, codec)
+		cs := &codecStruct{
+			Name:   "hehu",
+			Big:    1<<62 + 1,
+			Huge:   1<<64 - 1,
+			Small:  -3,
+			Ratio:  0.25,
+			Tags:   []string{"a", "b"},
+			Counts: map[string]int{"a": 1},
+			Inner:  &codecInner{Floats: []float64{1.5}},
+			Bytes:  []byte{},
+			Point:  codecPoint{X: 7, Y: -2},
+		}
+		if err := d.Set(cs); err != nil {
+			t.Fatalf(err.Error())
+		}
+		ids = append(ids, cs.Id)
+		loaded := &codecStruct{Id: cs.Id}
+		if err := d.Get(loaded); err != nil {
+			t.Fatalf(err.Error())
+		}
+		if codec == GobCodec {
+			cs.Bytes = nil
+		}
+		if !loaded.CreatedAt.Equal(cs.CreatedAt) {
+			t.Errorf("%#v: Wanted %v, got %v", codec, cs.CreatedAt, loaded.CreatedAt)
+		}
+		cs.CreatedAt, loaded.CreatedAt = time.Time{}, time.Time{}
+		if !reflect.DeepEqual(cs, loaded) {
+			t.Errorf("%#v: Wanted %+v, got %+v", codec, cs, loaded)
+		}
+	}
+	var res []codecStruct
+	if err := d.Query().Where(Equals{"Name", "hehu"}).All(&res); err != nil {
+		t.Fatalf(err.Error())
+	}
+	if len(res) != len(ids) {
+		t.Errorf("Wanted %v results of mixed codecs, got %+v", len(ids), res)
+	}
+}
+
+type indexName string
+
+type indexStruct struct {
+	Id     []byte
+	Int64  int64     `kol:"index"`
+	Uint32 uint32    `kol:"index"`
+	Float  float64   `kol:"index"`
+	Time   time.Time `kol:"index"`
+	Name   indexName `kol:"index"`
+	Small  int8      `kol:"index"`
+}
+
+func TestIndexBytesOrder(t *testing.T) {
+	now := time.Now()
+	for _, sorted := range [][]interface{}{
+		[]interface{}{int64(-1 << 40), -5, int8(-1), 0, int8(3), int16(300), 1 << 40},
+		[]interface{}{uint32(0), uint64(3), uint(1 << 40)},
+		[]interface{}{-1e10, float32(-2.5), -1.0, 0.0, 1e-10, 1.5, 1e10},
+		[]interface{}{time.Unix(-100, 5), time.Unix(0, 0), now, now.Add(time.Nanosecond), now.Add(time.Hour)},
+	} {
+		var last []byte
+		for _, i := range sorted {
+			value := reflect.ValueOf(i)
+			b, err := indexBytes(value.Type(), value)
+			if err != nil {
+				t.Fatalf(err.Error())
+			}
+			if last != nil && bytes.Compare(last, b) >= 0 {
+				t.Errorf("%v encoded to %v, which is not after %v", i, b, last)
+			}
+			last = b
+		}
+	}
+}
+
+func TestIndexTypes(t *testing.T) {
+	d, err := New("test")
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	d.Clear()
+	defer d.Close()
+	now := time.Now()
+	is := &indexStruct{
+		Int64:  -1 << 40,
+		Uint32: 7,
+		Float:  -2.5,
+		Time:   now,
+		Name:   "hehu",
+		Small:  -3,
+	}
+	if err := d.Set(is); err != nil {
+		t.Fatalf(err.Error())
+	}
+	if err := d.Set(&indexStruct{Time: now.Add(time.Second)}); err != nil {
+		t.Fatalf(err.Error())
+	}
+	for _, filter := range []QFilter{
+		Equals{"Int64", int64(-1 << 40)},
+		Equals{"Uint32", 7},
+		Equals{"Float", -2.5},
+		Equals{"Time", now},
+		Equals{"Name", "hehu"},
+		Equals{"Name", indexName("hehu")},
+		Equals{"Small", -3},
+	} {
+		var res []indexStruct
+		if err := d.Query().Where(filter).All(&res); err != nil {
+			t.Fatalf(err.Error())
+		}
+		if len(res) != 1 || bytes.Compare(res[0].Id, is.Id) != 0 {
+			t.Errorf("%+v: wanted %+v, got %+v", filter, is, res)
+		}
+		if matched, err := filter.match(d, reflect.TypeOf(*is), reflect.ValueOf(*is)); err != nil || !matched {
+			t.Errorf("%+v: wanted match for %+v, got %v, %v", filter, is, matched, err)
+		}
+	}
+}
+
+func TestRangeQuery(t *testing.T) {
+	d, err := New("test")
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	d.Clear()
+	defer d.Close()
+	now := time.Now()
+	var all []*indexStruct
+	for i := 0; i < 10; i++ {
+		is := &indexStruct{
+			Int64: int64(i - 5),
+			Float: float64(i) / 2,
+			Time:  now.Add(time.Duration(i) * time.Minute),
+			Name:  indexName(fmt.Sprintf("name%v", i%3)),
+		}
+		if err := d.Set(is); err != nil {
+			t.Fatalf(err.Error())
+		}
+		all = append(all, is)
+	}
+	for _, test := range []struct {
+		filter QFilter
+		wanted []int
+	}{
+		{GreaterThan{"Int64", 2}, []int{8, 9}},
+		{GreaterOrEqual{"Int64", 2}, []int{7, 8, 9}},
+		{LessThan{"Int64", -3}, []int{0, 1}},
+		{LessOrEqual{"Int64", -3}, []int{0, 1, 2}},
+		{Between{"Float", 1, 2}, []int{2, 3, 4}},
+		{Between{"Float", 10, 20}, nil},
+		{GreaterThan{"Time", now.Add(7 * time.Minute)}, []int{8, 9}},
+		{Prefix{"Name", "name1"}, []int{1, 4, 7}},
+		{Prefix{"Name", "nam"}, []int{0, 1, 2, 3, 4, 5, 6, 7, 8, 9}},
+		{And{Prefix{"Name", "name1"}, LessThan{"Int64", 0}}, []int{1, 4}},
+		{Or{GreaterThan{"Int64", 3}, LessThan{"Int64", -4}}, []int{0, 9}},
+	} {
+		var res []indexStruct
+		if err := d.Query().Where(test.filter).All(&res); err != nil {
+			t.Fatalf(err.Error())
+		}
+		found := map[string]bool{}
+		for _, is := range res {
+			found[string(is.Id)] = true
+		}
+		if len(found) != len(test.wanted) {
+			t.Errorf("%+v: wanted %v results, got %+v", test.filter, len(test.wanted), res)
+		}
+		for _, index := range test.wanted {
+			if !found[string(all[index].Id)] {
+				t.Errorf("%+v: wanted %+v in results, got %+v", test.filter, all[index], res)
+			}
+		}
+		for index, is := range all {
+			wanted := false
+			for _, i := range test.wanted {
+				wanted = wanted || i == index
+			}
+			if matched, err := test.filter.match(d, reflect.TypeOf(*is), reflect.ValueOf(*is)); err != nil || matched != wanted {
+				t.Errorf("%+v: wanted match of %+v to be %v, got %v, %v", test.filter, is, wanted, matched, err)
+			}
+		}
+	}
+	for _, filter := range []QFilter{
+		GreaterThan{"Uint32", -1},
+		LessThan{"Int64", 10.5},
+		Equals{"Small", 300},
+	} {
+		var res []indexStruct
+		if err := d.Query().Where(filter).All(&res); err == nil {
+			t.Errorf("%+v: wanted an error for a filter value that doesn't fit the field, got %+v", filter, res)
+		}
+	}
+	var res []indexStruct
+	if err := d.Query().Where(And{GreaterOrEqual{"Uint32", int64(0)}, LessThan{"Int64", 2.0}}).All(&res); err != nil || len(res) != 7 {
+		t.Errorf("Wanted 7 results for filter values that fit the fields, got %+v, %v", res, err)
+	}
+}
+
+func TestOrderBy(t *testing.T) {
+	d, err := New("test")
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	d.Clear()
+	defer d.Close()
+	for _, i := range []int{3, -2, 7, 0, 5, -9} {
+		if err := d.Set(&indexStruct{Int64: int64(i), Name: indexName(fmt.Sprintf("name%v", i%2))}); err != nil {
+			t.Fatalf(err.Error())
+		}
+	}
+	assertOrder := func(q *Query, wanted ...int64) {
+		var res []indexStruct
+		if err := q.All(&res); err != nil {
+			t.Fatalf(err.Error())
+		}
+		var found []int64
+		for _, is := range res {
+			found = append(found, is.Int64)
+		}
+		if !reflect.DeepEqual(found, wanted) {
+			t.Errorf("Wanted %v, got %v", wanted, found)
+		}
+	}
+	assertOrder(d.Query().OrderBy("Int64"), -9, -2, 0, 3, 5, 7)
+	assertOrder(d.Query().OrderByDesc("Int64"), 7, 5, 3, 0, -2, -9)
+	assertOrder(d.Query().OrderBy("Int64").Limit(2), -9, -2)
+	assertOrder(d.Query().OrderByDesc("Int64").Limit(2), 7, 5)
+	assertOrder(d.Query().Where(Equals{"Name", "name0"}).OrderBy("Int64"), -2, 0)
+	assertOrder(d.Query().Where(GreaterThan{"Int64", 0}).Except(Equals{"Int64", 5}).OrderByDesc("Int64").Limit(1), 7)
+	var first indexStruct
+	if found, err := d.Query().OrderByDesc("Int64").First(&first); err != nil || !found || first.Int64 != 7 {
+		t.Errorf("Wanted 7, got %+v, %v, %v", first, found, err)
+	}
+	var res []indexStruct
+	if err := d.Query().OrderBy("Id").All(&res); err == nil {
+		t.Errorf("Wanted an error when ordering by an unindexed field")
+	}
+}
+
+func TestPagination(t *testing.T) {
+	d, err := New("test")
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	d.Clear()
+	defer d.Close()
+	for i := 0; i < 7; i++ {
+		if err := d.Set(&indexStruct{Int64: int64(i)}); err != nil {
+			t.Fatalf(err.Error())
+		}
+	}
+	var res []indexStruct
+	if err := d.Query().OrderBy("Int64").Offset(2).Limit(2).All(&res); err != nil || len(res) != 2 || res[0].Int64 != 2 || res[1].Int64 != 3 {
+		t.Errorf("Wanted [2, 3], got %+v, %v", res, err)
+	}
+	var found []int64
+	token := ""
+	for page := 0; page == 0 || token != ""; page++ {
+		var res []indexStruct
+		if token, err = d.Query().OrderByDesc("Int64").Limit(3).After(token).Page(&res); err != nil {
+			t.Fatalf(err.Error())
+		}
+		for _, is := range res {
+			found = append(found, is.Int64)
+		}
+		if page == 0 {
+			// Inserting before the current position must not affect the following pages
+			if err := d.Set(&indexStruct{Int64: 100}); err != nil {
+				t.Fatalf(err.Error())
+			}
+			if err := d.Set(&indexStruct{Int64: -100}); err != nil {
+				t.Fatalf(err.Error())
+			}
+		}
+	}
+	if wanted := []int64{6, 5, 4, 3, 2, 1, 0, -100}; !reflect.DeepEqual(found, wanted) {
+		t.Errorf("Wanted %v, got %v", wanted, found)
+	}
+	var all []indexStruct
+	if err := d.Query().All(&all); err != nil {
+		t.Fatalf(err.Error())
+	}
+	var paged []indexStruct
+	for {
+		var res []indexStruct
+		if token, err = d.Query().Limit(2).After(token).Page(&res); err != nil {
+			t.Fatalf(err.Error())
+		}
+		paged = append(paged, res...)
+		if token == "" {
+			break
+		}
+	}
+	if len(paged) != len(all) {
+		t.Errorf("Wanted %v, got %v", len(all), len(paged))
+	}
+	for index := range all {
+		if bytes.Compare(all[index].Id, paged[index].Id) != 0 {
+			t.Errorf("Wanted %+v, got %+v", all[index], paged[index])
+		}
+	}
+	if _, err := d.Query().OrderByDesc("Int64").After(d.Query().OrderBy("Int64").encodeToken([][]byte{[]byte("x"), []byte("y")})).Page(&res); err == nil {
+		t.Errorf("Wanted an error for a token from another ordering")
+	}
+	for _, malformed := range []string{base64.URLEncoding.EncodeToString([]byte{0}), base64.URLEncoding.EncodeToString([]byte{0, 2}), "not base64!"} {
+		if _, err := d.Query().Limit(2).After(malformed).Page(&res); err == nil {
+			t.Errorf("Wanted an error for the malformed token %q", malformed)
+		}
+	}
+}
+
+func TestCount(t *testing.T) {
+	d, err := New("test")
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	d.Clear()
+	defer d.Close()
+	for i := 0; i < 7; i++ {
+		if err := d.Set(&indexStruct{Int64: int64(i), Name: indexName(fmt.Sprintf("name%v", i%2))}); err != nil {
+			t.Fatalf(err.Error())
+		}
+	}
+	if err := d.Set(&testStruct{Name: "name0"}); err != nil {
+		t.Fatalf(err.Error())
+	}
+	for _, test := range []struct {
+		query  *Query
+		wanted int
+	}{
+		{d.Query(), 7},
+		{d.Query().Where(Equals{"Name", "name0"}), 4},
+		{d.Query().Where(Equals{"Name", "name2"}), 0},
+		{d.Query().Where(GreaterThan{"Int64", 4}), 2},
+		{d.Query().Where(Equals{"Name", "name1"}).Except(Equals{"Int64", 3}), 2},
+	} {
+		if count, err := test.query.Count(&indexStruct{}); err != nil || count != test.wanted {
+			t.Errorf("Wanted %v, got %v, %v", test.wanted, count, err)
+		}
+		if exists, err := test.query.Exists(&indexStruct{}); err != nil || exists != (test.wanted > 0) {
+			t.Errorf("Wanted %v, got %v, %v", test.wanted > 0, exists, err)
+		}
+	}
+}
+
+type compositeStruct struct {
+	Id      []byte
+	Country string `kol:"composite<Country+City+Age>"`
+	City    string
+	Age     int
+	Name    string `kol:"index"`
+}
+
+func TestComposite(t *testing.T) {
+	d, err := New("test")
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	d.Clear()
+	defer d.Close()
+	RegisterComposite(&compositeStruct{}, "Name", "Age")
+	var all []*compositeStruct
+	for i := 0; i < 12; i++ {
+		cs := &compositeStruct{
+			Country: fmt.Sprintf("country%v", i%2),
+			City:    fmt.Sprintf("city%v", i%3),
+			Age:     i,
+			Name:    fmt.Sprintf("name%v", i%4),
+		}
+		if err := d.Set(cs); err != nil {
+			t.Fatalf(err.Error())
+		}
+		all = append(all, cs)
+	}
+	typ := reflect.TypeOf(compositeStruct{})
+	for _, test := range []struct {
+		filter  And
+		wanted  []int
+		planned bool
+	}{
+		{And{Equals{"Country", "country0"}, Equals{"City", "city0"}, Equals{"Age", 6}}, []int{6}, true},
+		{And{Equals{"Country", "country0"}, Equals{"City", "city0"}}, []int{0, 6}, true},
+		{And{Equals{"City", "city1"}, Equals{"Country", "country1"}, GreaterThan{"Age", 1}}, []int{7}, true},
+		{And{Equals{"Country", "country1"}, LessThan{"City", "city2"}}, []int{1, 3, 7, 9}, true},
+		{And{Equals{"Name", "name1"}, GreaterOrEqual{"Age", 5}}, []int{5, 9}, true},
+		{And{Equals{"Country", "country0"}, Equals{"City", "city0"}, Equals{"Name", "name2"}}, []int{6}, true},
+		{And{Equals{"Country", "country0"}, Equals{"City", "city3"}}, nil, true},
+		{And{Equals{"Name", "name2"}}, []int{2, 6, 10}, false},
+	} {
+		if _, _, planned, err := test.filter.compositeSource(d, typ); err != nil || planned != test.planned {
+			t.Errorf("%+v: wanted planned %v, got %v, %v", test.filter, test.planned, planned, err)
+		}
+		var res []compositeStruct
+		if err := d.Query().Where(test.filter).All(&res); err != nil {
+			t.Fatalf(err.Error())
+		}
+		found := map[string]bool{}
+		for _, cs := range res {
+			found[string(cs.Id)] = true
+		}
+		if len(found) != len(test.wanted) {
+			t.Errorf("%+v: wanted %v results, got %+v", test.filter, len(test.wanted), res)
+		}
+		for _, index := range test.wanted {
+			if !found[string(all[index].Id)] {
+				t.Errorf("%+v: wanted %+v in results, got %+v", test.filter, all[index], res)
+			}
+		}
+	}
+	all[6].City = "city1"
+	if err := d.Set(all[6]); err != nil {
+		t.Fatalf(err.Error())
+	}
+	var res []compositeStruct
+	if err := d.Query().Where(And{Equals{"Country", "country0"}, Equals{"City", "city0"}}).All(&res); err != nil || len(res) != 1 || res[0].Age != 0 {
+		t.Errorf("Wanted only age 0, got %+v, %v", res, err)
+	}
+	for _, cs := range all {
+		if err := d.Del(cs); err != nil {
+			t.Fatalf(err.Error())
+		}
+	}
+	if count := d.db.CountCollection(kc.Keyify(compositeIndex, typeName(typ))); count != 0 {
+		t.Errorf("Wanted no composite index entries, got %v", count)
+	}
+}
+
+type uniqueStruct struct {
+	Id     []byte
+	Email  string `kol:"unique"`
+	Tenant string `kol:"unique<Tenant+Handle>"`
+	Handle string
+}
+
+func TestUnique(t *testing.T) {
+	d, err := New("test")
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	d.Clear()
+	defer d.Close()
+	u1 := &uniqueStruct{Email: "a@b.c", Tenant: "t1", Handle: "a"}
+	if err := d.Set(u1); err != nil {
+		t.Fatalf(err.Error())
+	}
+	u2 := &uniqueStruct{Email: "a@b.c", Tenant: "t1", Handle: "b"}
+	if err := d.Set(u2); err == nil {
+		t.Errorf("Wanted an error for a duplicate email")
+	} else if violation, ok := err.(ErrUniqueViolation); !ok || violation.Field != "Email" || !violation.Id.Equals(Id(u1.Id)) {
+		t.Errorf("Wanted a unique violation of Email by %v, got %v", Id(u1.Id), err)
+	}
+	u2.Email = "b@b.c"
+	u2.Handle = "a"
+	u2.Id = nil
+	if err := d.Set(u2); err == nil {
+		t.Errorf("Wanted an error for a duplicate tenant and handle")
+	} else if violation, ok := err.(ErrUniqueViolation); !ok || violation.Field != "Tenant+Handle" {
+		t.Errorf("Wanted a unique violation of Tenant+Handle, got %v", err)
+	}
+	u2.Tenant = "t2"
+	u2.Id = nil
+	if err := d.Set(u2); err != nil {
+		t.Fatalf(err.Error())
+	}
+	if err := d.Set(u1); err != nil {
+		t.Errorf("Wanted resaving to be ok, got %v", err)
+	}
+	found := &uniqueStruct{}
+	if err := d.GetUnique(found, "Email", "b@b.c"); err != nil || !reflect.DeepEqual(found, u2) {
+		t.Errorf("Wanted %+v, got %+v, %v", u2, found, err)
+	}
+	found = &uniqueStruct{}
+	if err := d.GetUnique(found, "Tenant+Handle", "t1", "a"); err != nil || !reflect.DeepEqual(found, u1) {
+		t.Errorf("Wanted %+v, got %+v, %v", u1, found, err)
+	}
+	var res []uniqueStruct
+	if err := d.Query().Where(Equals{"Email", "a@b.c"}).All(&res); err != nil || len(res) != 1 {
+		t.Errorf("Wanted one result, got %+v, %v", res, err)
+	}
+	u1.Email = "c@b.c"
+	if err := d.Set(u1); err != nil {
+		t.Fatalf(err.Error())
+	}
+	if err := d.GetUnique(&uniqueStruct{}, "Email", "a@b.c"); err != NotFound {
+		t.Errorf("Wanted NotFound, got %v", err)
+	}
+	u2.Email = "a@b.c"
+	if err := d.Set(u2); err != nil {
+		t.Errorf("Wanted a released email to be available, got %v", err)
+	}
+	if err := d.Del(u1); err != nil {
+		t.Fatalf(err.Error())
+	}
+	if err := d.Set(&uniqueStruct{Email: "c@b.c", Tenant: "t1", Handle: "a"}); err != nil {
+		t.Errorf("Wanted deleted values to be available, got %v", err)
+	}
+	if err := d.GetUnique(&uniqueStruct{}, "Handle", "a"); err == nil {
+		t.Errorf("Wanted an error for a field without unique constraint")
+	}
+}
+
+type tagStruct struct {
+	Id     []byte
+	Tags   []string `kol:"index"`
+	Scores [2]int   `kol:"index"`
+}
+
+func TestMultiValued(t *testing.T) {
+	d, err := New("test")
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	d.Clear()
+	defer d.Close()
+	all := []*tagStruct{
+		&tagStruct{Tags: []string{"go", "db"}, Scores: [2]int{1, 5}},
+		&tagStruct{Tags: []string{"go", "go", "web"}, Scores: [2]int{3, 3}},
+		&tagStruct{Tags: []string{"db"}, Scores: [2]int{7, 9}},
+		&tagStruct{},
+	}
+	for _, ts := range all {
+		if err := d.Set(ts); err != nil {
+			t.Fatalf(err.Error())
+		}
+	}
+	assertResults := func(filter QFilter, wanted ...int) {
+		var res []tagStruct
+		if err := d.Query().Where(filter).All(&res); err != nil {
+			t.Fatalf(err.Error())
+		}
+		found := map[string]bool{}
+		for _, ts := range res {
+			found[string(ts.Id)] = true
+		}
+		if len(found) != len(wanted) || len(res) != len(wanted) {
+			t.Errorf("%+v: wanted %v results, got %+v", filter, len(wanted), res)
+		}
+		for index, ts := range all {
+			isWanted := false
+			for _, i := range wanted {
+				isWanted = isWanted || i == index
+			}
+			if isWanted && !found[string(ts.Id)] {
+				t.Errorf("%+v: wanted %+v in results, got %+v", filter, ts, res)
+			}
+			if matched, err := filter.match(d, reflect.TypeOf(*ts), reflect.ValueOf(*ts)); err != nil || matched != isWanted {
+				t.Errorf("%+v: wanted match of %+v to be %v, got %v, %v", filter, ts, isWanted, matched, err)
+			}
+		}
+	}
+	assertResults(Equals{"Tags", "go"}, 0, 1)
+	assertResults(Contains{"Tags", "db"}, 0, 2)
+	assertResults(ContainsAny{"Tags", []interface{}{"web", "db"}}, 0, 1, 2)
+	assertResults(ContainsAll{"Tags", []interface{}{"go", "db"}}, 0)
+	assertResults(ContainsAny{"Tags", nil})
+	assertResults(Contains{"Scores", 3}, 1)
+	assertResults(GreaterThan{"Scores", 6}, 2)
+	assertResults(Between{"Scores", 4, 6}, 0)
+	all[1].Tags = []string{"web", "db"}
+	if err := d.Set(all[1]); err != nil {
+		t.Fatalf(err.Error())
+	}
+	assertResults(Contains{"Tags", "go"}, 0)
+	assertResults(ContainsAll{"Tags", []interface{}{"web", "db"}}, 1)
+	for _, ts := range all {
+		if err := d.Del(ts); err != nil {
+			t.Fatalf(err.Error())
+		}
+	}
+	if count := d.db.CountCollection(kc.Keyify(secondaryIndex, typeName(reflect.TypeOf(tagStruct{})))); count != 0 {
+		t.Errorf("Wanted no index entries, got %v", count)
+	}
+	var res []tagStruct
+	if err := d.Query().OrderBy("Tags").All(&res); err == nil {
+		t.Errorf("Wanted an error when ordering by a multi valued field")
+	}
+}
+
+type NestedLocation struct {
+	City string `kol:"index"`
+}
+
+type nestedAddress struct {
+	NestedLocation
+	Street string
+	Zip    int `kol:"index"`
+}
+
+type NestedAudit struct {
+	Owner string `kol:"index"`
+}
+
+type nestedStruct struct {
+	Id []byte
+	*NestedAudit
+	Home    nestedAddress `kol:"composite<Home.City+Home.Zip>"`
+	Work    *nestedAddress
+	Country string
+}
+
+func TestNested(t *testing.T) {
+	d, err := New("test")
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	d.Clear()
+	defer d.Close()
+	all := []*nestedStruct{
+		&nestedStruct{NestedAudit: &NestedAudit{Owner: "a"}, Home: nestedAddress{NestedLocation{"x"}, "s1", 1}},
+		&nestedStruct{Home: nestedAddress{NestedLocation{"y"}, "s2", 2}, Work: &nestedAddress{NestedLocation{"x"}, "s3", 3}},
+		&nestedStruct{NestedAudit: &NestedAudit{Owner: "b"}, Home: nestedAddress{NestedLocation{"x"}, "s4", 4}},
+	}
+	for _, ns := range all {
+		if err := d.Set(ns); err != nil {
+			t.Fatalf(err.Error())
+		}
+	}
+	typ := reflect.TypeOf(nestedStruct{})
+	for _, path := range []string{"Owner", "Home.City", "Home.Zip", "Work.City", "Work.Zip"} {
+		if !isIndexed(typ, path) {
+			t.Errorf("Wanted %v to be indexed", path)
+		}
+	}
+	for _, test := range []struct {
+		filter QFilter
+		wanted []int
+	}{
+		{Equals{"Owner", "a"}, []int{0}},
+		{Equals{"Home.City", "x"}, []int{0, 2}},
+		{Equals{"Work.City", "x"}, []int{1}},
+		{Equals{"Work.Zip", 0}, nil},
+		{GreaterThan{"Home.Zip", 1}, []int{1, 2}},
+		{And{Equals{"Home.City", "x"}, LessThan{"Home.Zip", 3}}, []int{0}},
+	} {
+		var res []nestedStruct
+		if err := d.Query().Where(test.filter).All(&res); err != nil {
+			t.Fatalf(err.Error())
+		}
+		found := map[string]bool{}
+		for _, ns := range res {
+			found[string(ns.Id)] = true
+		}
+		if len(found) != len(test.wanted) {
+			t.Errorf("%+v: wanted %v results, got %+v", test.filter, len(test.wanted), res)
+		}
+		for index, ns := range all {
+			wanted := false
+			for _, i := range test.wanted {
+				wanted = wanted || i == index
+			}
+			if wanted && !found[string(ns.Id)] {
+				t.Errorf("%+v: wanted %+v in results, got %+v", test.filter, ns, res)
+			}
+			if matched, err := test.filter.match(d, typ, reflect.ValueOf(*ns)); err != nil || matched != wanted {
+				t.Errorf("%+v: wanted match of %+v to be %v, got %v, %v", test.filter, ns, wanted, matched, err)
+			}
+		}
+	}
+	if _, err := (Equals{"Home.Country", "x"}).match(d, typ, reflect.ValueOf(*all[0])); err == nil {
+		t.Errorf("Wanted an error for a missing nested field")
+	}
+	all[1].Work = nil
+	if err := d.Set(all[1]); err != nil {
+		t.Fatalf(err.Error())
+	}
+	var res []nestedStruct
+	if err := d.Query().Where(Equals{"Work.City", "x"}).All(&res); err != nil || len(res) != 0 {
+		t.Errorf("Wanted no results, got %+v, %v", res, err)
+	}
+}
+
+type textStruct struct {
+	Id     []byte
+	Body   string   `kol:"fulltext"`
+	Labels []string `kol:"fulltext"`
+	Author string   `kol:"index"`
+}
+
+func TestFulltext(t *testing.T) {
+	d, err := New("test")
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	d.Clear()
+	defer d.Close()
+	if terms := EnglishAnalyzer.Terms("The Dogs were running, and the cat jumped!"); !reflect.DeepEqual(terms, []string{"dog", "were", "run", "cat", "jump"}) {
+		t.Errorf("Wanted analyzed terms, got %v", terms)
+	}
+	if terms := (TextAnalyzer{}).Terms("Smörgåsbord, 42 Ärter"); !reflect.DeepEqual(terms, []string{"smörgåsbord", "42", "ärter"}) {
+		t.Errorf("Wanted unicode words, got %v", terms)
+	}
+	all := []*textStruct{
+		&textStruct{Body: "Go is fun, go go go!", Author: "a"},
+		&textStruct{Body: "Kyoto Cabinet is a database", Labels: []string{"go", "db"}, Author: "b"},
+		&textStruct{Body: "Go and Go databases", Author: "a"},
+		&textStruct{Body: "Nothing to see here", Author: "b"},
+	}
+	for _, ts := range all {
+		if err := d.Set(ts); err != nil {
+			t.Fatalf(err.Error())
+		}
+	}
+	assertResults := func(q *Query, filter QFilter, wanted ...int) {
+		var res []textStruct
+		if err := q.All(&res); err != nil {
+			t.Fatalf(err.Error())
+		}
+		var found []int
+		for _, ts := range res {
+			for index, other := range all {
+				if bytes.Compare(ts.Id, other.Id) == 0 {
+					found = append(found, index)
+				}
+			}
+		}
+		if q.rankBy == nil {
+			sort.Ints(found)
+		}
+		if !reflect.DeepEqual(found, wanted) {
+			t.Errorf("%+v: wanted %v, got %v", filter, wanted, found)
+		}
+		for index, ts := range all {
+			isWanted := false
+			for _, i := range wanted {
+				isWanted = isWanted || i == index
+			}
+			if matched, err := filter.match(d, reflect.TypeOf(*ts), reflect.ValueOf(*ts)); err != nil || matched != isWanted {
+				t.Errorf("%+v: wanted match of %+v to be %v, got %v, %v", filter, ts, isWanted, matched, err)
+			}
+		}
+	}
+	goBody := Match{"Body", "GO"}
+	assertResults(d.Query().Where(goBody), goBody, 0, 2)
+	assertResults(d.Query().Where(goBody).RankBy(goBody), goBody, 0, 2)
+	assertResults(d.Query().Where(Match{"Body", "go database"}), Match{"Body", "go database"})
+	assertResults(d.Query().Where(Match{"Body", "go databases"}), Match{"Body", "go databases"}, 2)
+	assertResults(d.Query().Where(Match{"Labels", "go"}), Match{"Labels", "go"}, 1)
+	assertResults(d.Query().Where(Match{"Body", ""}), Match{"Body", ""})
+	either := Or{Match{"Body", "go"}, Match{"Labels", "go"}}
+	assertResults(d.Query().Where(either), either, 0, 1, 2)
+	both := And{Match{"Body", "go"}, Equals{"Author", "a"}}
+	assertResults(d.Query().Where(both), both, 0, 2)
+	all[2].Body = "Go go go go go go"
+	if err := d.Set(all[2]); err != nil {
+		t.Fatalf(err.Error())
+	}
+	assertResults(d.Query().Where(goBody).RankBy(goBody), goBody, 2, 0)
+	var res []textStruct
+	token, err := d.Query().Where(goBody).RankBy(goBody).Limit(1).Page(&res)
+	if err != nil || len(res) != 1 || bytes.Compare(res[0].Id, all[2].Id) != 0 {
+		t.Fatalf("Wanted %+v, got %+v, %v", all[2], res, err)
+	}
+	res = nil
+	if _, err = d.Query().Where(goBody).RankBy(goBody).Limit(1).After(token).Page(&res); err != nil || len(res) != 1 || bytes.Compare(res[0].Id, all[0].Id) != 0 {
+		t.Errorf("Wanted %+v, got %+v, %v", all[0], res, err)
+	}
+	d.SetAnalyzer(EnglishAnalyzer)
+	if err := d.Del(all[1]); err != nil {
+		t.Errorf("Wanted deleting after changing Analyzer to work, got %v", err)
+	}
+}
+
+func TestNotIn(t *testing.T) {
+	d, err := New("test")
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	d.Clear()
+	defer d.Close()
+	var all []*indexStruct
+	for i := 0; i < 6; i++ {
+		is := &indexStruct{Int64: int64(i), Name: indexName(fmt.Sprintf("name%v", i%3))}
+		if err := d.Set(is); err != nil {
+			t.Fatalf(err.Error())
+		}
+		all = append(all, is)
+	}
+	for _, test := range []struct {
+		query  *Query
+		wanted []int64
+	}{
+		{d.Query().Where(Not{Equals{"Name", "name0"}}), []int64{1, 2, 4, 5}},
+		{d.Query().Where(In{"Int64", []interface{}{1, 3, 5, 7}}), []int64{1, 3, 5}},
+		{d.Query().Where(In{"Int64", nil}), nil},
+		{d.Query().Where(And{Not{In{"Name", []interface{}{"name1", "name2"}}}, GreaterThan{"Int64", 0}}), []int64{3}},
+		{d.Query().Where(Or{Not{LessThan{"Int64", 4}}, Equals{"Int64", 0}}), []int64{0, 4, 5}},
+		{d.Query().Where(Not{Not{Equals{"Int64", 2}}}), []int64{2}},
+		{d.Query().Where(GreaterThan{"Int64", 0}).Where(Equals{"Name", "name1"}), []int64{1, 4}},
+		{d.Query().Where(And{GreaterThan{"Int64", 0}}).Where(LessThan{"Int64", 3}).Where(Not{Equals{"Int64", 1}}), []int64{2}},
+		{d.Query().Except(Equals{"Int64", 0}).Except(Equals{"Name", "name1"}), []int64{2, 3, 5}},
+	} {
+		var res []indexStruct
+		if err := test.query.OrderBy("Int64").All(&res); err != nil {
+			t.Fatalf(err.Error())
+		}
+		var found []int64
+		for _, is := range res {
+			found = append(found, is.Int64)
+		}
+		if !reflect.DeepEqual(found, test.wanted) {
+			t.Errorf("%+v, %+v: wanted %v, got %v", test.query.intersection, test.query.difference, test.wanted, found)
+		}
+		for _, is := range all {
+			wanted := false
+			for _, i := range test.wanted {
+				wanted = wanted || i == is.Int64
+			}
+			if matched, err := test.query.match(reflect.TypeOf(*is), reflect.ValueOf(*is)); err != nil || matched != wanted {
+				t.Errorf("%+v, %+v: wanted match of %+v to be %v, got %v, %v", test.query.intersection, test.query.difference, is, wanted, matched, err)
+			}
+		}
+	}
+}
+
+func TestParseQuery(t *testing.T) {
+	d, err := New("test")
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	d.Clear()
+	defer d.Close()
+	now := time.Now()
+	for i := 0; i < 6; i++ {
+		if err := d.Set(&indexStruct{
+			Int64: int64(i),
+			Float: float64(i) / 2,
+			Time:  now.Add(time.Duration(i) * time.Hour),
+			Name:  indexName(fmt.Sprintf("name%v", i%3)),
+		}); err != nil {
+			t.Fatalf(err.Error())
+		}
+	}
+	for _, test := range []struct {
+		text   string
+		wanted []int64
+	}{
+		{"", []int64{0, 1, 2, 3, 4, 5}},
+		{"Int64 = 3", []int64{3}},
+		{"Name = 'name1' AND Int64 > 1", []int64{4}},
+		{"Name = \"name0\" or Int64 >= 4 order by Int64", []int64{0, 3, 4, 5}},
+		{"NOT (Name = 'name0' OR Name = 'name1') AND Int64 != 2", []int64{5}},
+		{"Int64 IN (1, 2, 7) ORDER BY Int64 DESC", []int64{2, 1}},
+		{"Int64 NOT IN (1, 2)", []int64{0, 3, 4, 5}},
+		{"Float BETWEEN 0.5 AND 1.5", []int64{1, 2, 3}},
+		{"Float < -1", nil},
+		{"Name PREFIX 'name' AND Int64 <= 1", []int64{0, 1}},
+		{"Time > '" + now.Add(150*time.Minute).Format(time.RFC3339Nano) + "'", []int64{3, 4, 5}},
+		{"ORDER BY Int64 DESC LIMIT 2 OFFSET 1", []int64{4, 3}},
+	} {
+		q, err := d.ParseQuery(&indexStruct{}, test.text)
+		if err != nil {
+			t.Errorf("%q: %v", test.text, err)
+			continue
+		}
+		if q.orderBy == "" {
+			q.OrderBy("Int64")
+		}
+		var res []indexStruct
+		if err := q.All(&res); err != nil {
+			t.Fatalf(err.Error())
+		}
+		var found []int64
+		for _, is := range res {
+			found = append(found, is.Int64)
+		}
+		if !reflect.DeepEqual(found, test.wanted) {
+			t.Errorf("%q: wanted %v, got %v", test.text, test.wanted, found)
+		}
+	}
+	for _, test := range []struct {
+		text     string
+		position int
+	}{
+		{"Int64 = ", 8},
+		{"Int64 = 1 AND", 13},
+		{"Int64 == 1", 6},
+		{"Id = 'x'", 0},
+		{"Missing = 1", 0},
+		{"int64 = 1", 0},
+		{"(Int64 = 1", 10},
+		{"Int64 = 'unterminated", 8},
+		{"Int64 ~ 1", 6},
+		{"Int64 = 1 LIMIT x", 16},
+		{"Int64 = 1 Int64 = 2", 10},
+		{"MATCH Name 'x'", 6},
+		{"Time > 'yesterday'", 7},
+		{"Int64 = '30'", 8},
+		{"Name = 30", 7},
+		{"Float > true", 8},
+		{"Time > 5", 7},
+		{"Int64 IN (1, 'two')", 13},
+		{"Name BETWEEN 'a' AND 2", 21},
+	} {
+		if _, err := d.ParseQuery(&indexStruct{}, test.text); err == nil {
+			t.Errorf("%q: wanted an error", test.text)
+		} else if parseErr, ok := err.(ParseError); !ok || parseErr.Position != test.position {
+			t.Errorf("%q: wanted a ParseError at %v, got %v", test.text, test.position, err)
+		}
+	}
+	d.Set(&textStruct{Body: "hello world", Labels: []string{"x", "y"}})
+	var res []textStruct
+	if q, err := d.ParseQuery(&textStruct{}, "MATCH Body 'World' AND Author = ''"); err != nil {
+		t.Errorf("Wanted a query, got %v", err)
+	} else if err := q.All(&res); err != nil || len(res) != 1 {
+		t.Errorf("Wanted one result, got %+v, %v", res, err)
+	}
+}
+
+func TestExplain(t *testing.T) {
+	d, err := New("test")
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	d.Clear()
+	defer d.Close()
+	for i := 0; i < 6; i++ {
+		if err := d.Set(&indexStruct{Int64: int64(i), Name: indexName(fmt.Sprintf("name%v", i%3))}); err != nil {
+			t.Fatalf(err.Error())
+		}
+	}
+	q := d.Query().Where(Equals{"Name", "name1"}).Except(GreaterThan{"Int64", 3}).OrderByDesc("Int64")
+	plan, err := q.Explain(&indexStruct{})
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	if plan.Operation != "Difference" || len(plan.Sources) != 2 || plan.Sources[0].Operation != "Intersection" || plan.Traced {
+		t.Fatalf("Wanted an untraced Difference of an Intersection, got %v", plan)
+	}
+	typ := typeName(reflect.TypeOf(indexStruct{}))
+	if pk := plan.Sources[0].Sources[0]; pk.Keyspace != primaryKey || pk.Key != fmt.Sprintf("pk/%v", typ) {
+		t.Errorf("Wanted the primary key, got %+v", pk)
+	}
+	if name := plan.Sources[0].Sources[1]; name.Keyspace != secondaryIndex || name.Key != fmt.Sprintf("2i/%v/Name/\"name1\"", typ) {
+		t.Errorf("Wanted the Name index, got %+v", name)
+	}
+	if wanted := fmt.Sprintf("Int64 descending in 2i/%v/Int64", typ); plan.Order != wanted {
+		t.Errorf("Wanted %q, got %q", wanted, plan.Order)
+	}
+	if plan, err = q.Trace(&indexStruct{}); err != nil {
+		t.Fatalf(err.Error())
+	}
+	if !plan.Traced || plan.Count != 1 || plan.Sources[0].Count != 2 || plan.Sources[0].Sources[0].Count != 6 || plan.Sources[1].Count != 2 {
+		t.Errorf("Wanted traced counts, got %v", plan)
+	}
+	if plan.Matches != 1 || plan.Elapsed <= 0 {
+		t.Errorf("Wanted the whole query to be measured, got %+v", plan)
+	}
+	if lines := strings.Split(strings.TrimSpace(plan.String()), "\n"); len(lines) != 7 || !strings.HasPrefix(lines[0], "Difference [1 keys in ") || !strings.Contains(lines[0], "[1 matches in ") {
+		t.Errorf("Wanted a readable plan, got %v", plan)
+	}
+}
+
+func TestScan(t *testing.T) {
+	d, err := New("test")
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	d.Clear()
+	defer d.Close()
+	for i := 0; i < 6; i++ {
+		if err := d.Set(&nestedStruct{Country: fmt.Sprintf("country%v", i%2), Home: nestedAddress{NestedLocation{fmt.Sprintf("city%v", i%3)}, fmt.Sprintf("street%v", i), i}}); err != nil {
+			t.Fatalf(err.Error())
+		}
+	}
+	var res []nestedStruct
+	for _, filter := range []QFilter{Equals{"Country", "country0"}, Prefix{"Home.Street", "s"}, Match{"Country", "x"}, And{Equals{"Home.City", "city0"}, Not{Equals{"Country", "country0"}}}} {
+		if err := d.Query().Where(filter).All(&res); err == nil || !strings.Contains(err.Error(), "Scan") {
+			t.Errorf("%+v: wanted an error suggesting Scan, got %v", filter, err)
+		}
+	}
+	for _, test := range []struct {
+		query  *Query
+		wanted []int
+	}{
+		{d.Query().Where(Equals{"Country", "country0"}), []int{0, 2, 4}},
+		{d.Query().Where(Equals{"Home.City", "city0"}).Where(Not{Equals{"Country", "country0"}}), []int{3}},
+		{d.Query().Where(Or{Equals{"Home.City", "city1"}, Prefix{"Home.Street", "street5"}}), []int{1, 4, 5}},
+		{d.Query().Where(GreaterThan{"Home.Zip", 0}).Except(Equals{"Country", "country1"}), []int{2, 4}},
+		{d.Query().Where(Equals{"Country", "country1"}).Offset(1).Limit(1), []int{3}},
+	} {
+		res = nil
+		if err := test.query.Scan().OrderBy("Home.Zip").All(&res); err != nil {
+			t.Fatalf(err.Error())
+		}
+		var found []int
+		for _, ns := range res {
+			found = append(found, ns.Home.Zip)
+		}
+		if !reflect.DeepEqual(found, test.wanted) {
+			t.Errorf("%+v, %+v: wanted %v, got %v", test.query.intersection, test.query.difference, test.wanted, found)
+		}
+		if test.query.limit == 0 {
+			if count, err := test.query.Count(&nestedStruct{}); err != nil || count != len(test.wanted) {
+				t.Errorf("%+v, %+v: wanted %v, got %v, %v", test.query.intersection, test.query.difference, len(test.wanted), count, err)
+			}
+		}
+		if exists, err := test.query.Exists(&nestedStruct{}); err != nil || exists != (len(test.wanted) > 0) {
+			t.Errorf("%+v, %+v: wanted %v, got %v, %v", test.query.intersection, test.query.difference, len(test.wanted) > 0, exists, err)
+		}
+	}
+	for i := 0; i < 2*existsBatch; i++ {
+		if err := d.Set(&nestedStruct{Country: "bulk", Home: nestedAddress{Zip: 100 + i}}); err != nil {
+			t.Fatalf(err.Error())
+		}
+	}
+	for _, country := range []string{"country0", "missing"} {
+		if exists, err := d.Query().Where(GreaterThan{"Home.Zip", 2}).Where(Equals{"Country", country}).Scan().Exists(&nestedStruct{}); err != nil || exists != (country == "country0") {
+			t.Errorf("Wanted a match for %v to exist: %v, got %v, %v", country, country == "country0", exists, err)
+		}
+	}
+	if plan, err := d.Query().Where(And{Equals{"Home.City", "city0"}, Equals{"Country", "country1"}}).Scan().Explain(&nestedStruct{}); err != nil || !plan.Filtered || len(plan.Sources) != 2 || plan.Sources[1].Sources[0].Keyspace != secondaryIndex {
+		t.Errorf("Wanted a filtered plan using the Home.City index, got %v, %v", plan, err)
+	}
+}
+
+type migrationStruct struct {
+	Id   []byte
+	Name string `kol:"index"`
+	Age  int
+	Nick string `kol:"index"`
+}
+
+func TestOldIndexFormat(t *testing.T) {
+	d, err := New("test")
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	d.Clear()
+	defer d.Close()
+	is := &indexStruct{Int64: 5, Name: "old"}
+	if err := d.Set(is); err != nil {
+		t.Fatalf(err.Error())
+	}
+	typ := typeName(reflect.TypeOf(indexStruct{}))
+	if err := d.db.Remove(kc.Keyify(secondaryIndex, typ, "Int64", uint64Bytes(uint64(5)^(1<<63)), is.Id)); err != nil {
+		t.Fatalf(err.Error())
+	}
+	// The int encoding before the sign bit was flipped
+	old := new(bytes.Buffer)
+	if err := binary.Write(old, binary.BigEndian, int64(5)); err != nil {
+		t.Fatalf(err.Error())
+	}
+	if err := d.db.Set(kc.Keyify(secondaryIndex, typ, "Int64", old.Bytes(), is.Id), []byte{0}); err != nil {
+		t.Fatalf(err.Error())
+	}
+	is.Int64 = 6
+	if err := d.Set(is); err != nil {
+		t.Fatalf("Wanted to be able to update an object indexed in the old format, got %v", err)
+	}
+	if err := d.EnsureIndexes(&indexStruct{}); err != nil {
+		t.Fatalf(err.Error())
+	}
+	if count := d.db.CountCollection(kc.Keyify(secondaryIndex, typ, "Int64")); count != 1 {
+		t.Errorf("Wanted the old entry to be removed by reindexing, got %v entries", count)
+	}
+	var res []indexStruct
+	if err := d.Query().Where(Equals{"Int64", 6}).All(&res); err != nil || len(res) != 1 {
+		t.Errorf("Wanted the updated object, got %+v, %v", res, err)
+	}
+	if err := d.Del(is); err != nil {
+		t.Fatalf(err.Error())
+	}
+}
+
+type reindexBefore struct {
+	Id   []byte
+	Name string `kol:"index"`
+}
+
+func (self reindexBefore) KolType() string {
+	return "reindexUnique"
+}
+
+type reindexAfter struct {
+	Id   []byte
+	Name string `kol:"index,unique"`
+}
+
+func (self reindexAfter) KolType() string {
+	return "reindexUnique"
+}
+
+func TestReindexUniqueViolation(t *testing.T) {
+	d, err := New("test")
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	d.Clear()
+	defer d.Close()
+	for _, name := range []string{"a", "b", "a"} {
+		if err := d.Set(&reindexBefore{Name: name}); err != nil {
+			t.Fatalf(err.Error())
+		}
+	}
+	if err := d.Reindex(&reindexAfter{}); err == nil {
+		t.Fatalf("Wanted an error when reindexing duplicate values of a unique field")
+	} else if _, ok := err.(ErrUniqueViolation); !ok {
+		t.Errorf("Wanted a unique violation, got %v", err)
+	}
+	var res []reindexAfter
+	if err := d.Query().Where(Equals{"Name", "a"}).All(&res); err != nil || len(res) != 2 {
+		t.Fatalf("Wanted the index entries to be intact, got %+v, %v", res, err)
+	}
+	res[0].Name = "c"
+	if err := d.Set(&res[0]); err != nil {
+		t.Fatalf(err.Error())
+	}
+	if err := d.Reindex(&reindexAfter{}); err != nil {
+		t.Fatalf(err.Error())
+	}
+	if err := d.Set(&reindexAfter{Name: "b"}); err == nil {
+		t.Errorf("Wanted a unique violation after reindexing")
+	}
+}
+
+func TestReindexAndMigrate(t *testing.T) {
+	d, err := New("test")
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	d.Clear()
+	defer d.Close()
+	for i := 0; i < migrationBatch+44; i++ {
+		if err := d.Set(&migrationStruct{Name: fmt.Sprintf("name%v", i%3), Age: i}); err != nil {
+			t.Fatalf(err.Error())
+		}
+	}
+	if changed, err := d.IndexesChanged(&migrationStruct{}); err != nil || !changed {
+		t.Errorf("Wanted unknown index layout to be changed, got %v, %v", changed, err)
+	}
+	if err := d.EnsureIndexes(&migrationStruct{}); err != nil {
+		t.Fatalf(err.Error())
+	}
+	if changed, err := d.IndexesChanged(&migrationStruct{}); err != nil || changed {
+		t.Errorf("Wanted unchanged index layout, got %v, %v", changed, err)
+	}
+	RegisterComposite(&migrationStruct{}, "Name", "Age")
+	if changed, err := d.IndexesChanged(&migrationStruct{}); err != nil || !changed {
+		t.Errorf("Wanted changed index layout after adding a composite index, got %v, %v", changed, err)
+	}
+	var res []migrationStruct
+	filter := And{Equals{"Name", "name1"}, Equals{"Age", 4}}
+	if err := d.Query().Where(filter).All(&res); err != nil || len(res) != 0 {
+		t.Errorf("Wanted no results before reindexing, got %+v, %v", res, err)
+	}
+	if err := d.EnsureIndexes(&migrationStruct{}); err != nil {
+		t.Fatalf(err.Error())
+	}
+	if err := d.Query().Where(filter).All(&res); err != nil || len(res) != 1 || res[0].Age != 4 {
+		t.Errorf("Wanted age 4 after reindexing, got %+v, %v", res, err)
+	}
+	typ := reflect.TypeOf(migrationStruct{})
+	if count := d.db.CountCollection(kc.Keyify(compositeIndex, typeName(typ))); count != migrationBatch+44 {
+		t.Errorf("Wanted %v composite index entries, got %v", migrationBatch+44, count)
+	}
+	d.RegisterMigration(&migrationStruct{}, 2, func(obj interface{}) error {
+		ms := obj.(*migrationStruct)
+		ms.Nick = ms.Name + "!"
+		return nil
+	})
+	d.RegisterMigration(&migrationStruct{}, 1, func(obj interface{}) error {
+		obj.(*migrationStruct).Age *= 2
+		return nil
+	})
+	if version, err := d.SchemaVersion(&migrationStruct{}); err != nil || version != 0 {
+		t.Errorf("Wanted version 0, got %v, %v", version, err)
+	}
+	for i := 0; i < 2; i++ {
+		if err := d.Migrate(&migrationStruct{}); err != nil {
+			t.Fatalf(err.Error())
+		}
+		if version, err := d.SchemaVersion(&migrationStruct{}); err != nil || version != 2 {
+			t.Errorf("Wanted version 2, got %v, %v", version, err)
+		}
+		res = nil
+		if err := d.Query().Where(And{Equals{"Name", "name1"}, Equals{"Age", 8}}).All(&res); err != nil || len(res) != 1 || res[0].Nick != "name1!" {
+			t.Errorf("Wanted the migrated age 8 with nick name1!, got %+v, %v", res, err)
+		}
+		res = nil
+		if err := d.Query().Where(filter).All(&res); err != nil || len(res) != 0 {
+			t.Errorf("Wanted no results for the old age, got %+v, %v", res, err)
+		}
+		if count, err := d.Query().Where(Equals{"Nick", "name2!"}).Count(&migrationStruct{}); err != nil || count != (migrationBatch+44)/3 {
+			t.Errorf("Wanted %v migrated nicks, got %v, %v", (migrationBatch+44)/3, count, err)
+		}
+	}
+	calls := 0
+	d.RegisterMigration(&migrationStruct{}, 3, func(obj interface{}) error {
+		if calls++; calls == migrationBatch+10 {
+			return fmt.Errorf("Failing in the second batch")
+		}
+		obj.(*migrationStruct).Age++
+		return nil
+	})
+	if err := d.Migrate(&migrationStruct{}); err == nil {
+		t.Fatalf("Wanted the failing migration to fail")
+	}
+	if version, err := d.SchemaVersion(&migrationStruct{}); err != nil || version != 2 {
+		t.Errorf("Wanted version 2 after the failed migration, got %v, %v", version, err)
+	}
+	if err := d.Migrate(&migrationStruct{}); err != nil {
+		t.Fatalf(err.Error())
+	}
+	res = nil
+	if err := d.Query().All(&res); err != nil || len(res) != migrationBatch+44 {
+		t.Fatalf("Wanted %v results, got %v, %v", migrationBatch+44, len(res), err)
+	}
+	for _, ms := range res {
+		if ms.Age%2 != 1 {
+			t.Errorf("Wanted each object to be migrated once, got %+v", ms)
+		}
+	}
+}
+
+type versionedStruct struct {
+	Id      []byte
+	Name    string `kol:"unique"`
+	Version int
+}
+
+func TestVersion(t *testing.T) {
+	d, err := New("test")
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	d.Clear()
+	defer d.Close()
+	vs := &versionedStruct{Name: "a"}
+	if err := d.Set(vs); err != nil {
+		t.Fatalf(err.Error())
+	}
+	if vs.Version != 1 {
+		t.Errorf("Wanted version 1, got %+v", vs)
+	}
+	stale := &versionedStruct{Id: vs.Id}
+	if err := d.Get(stale); err != nil {
+		t.Fatalf(err.Error())
+	}
+	vs.Name = "b"
+	if err := d.Set(vs); err != nil {
+		t.Fatalf(err.Error())
+	}
+	if vs.Version != 2 {
+		t.Errorf("Wanted version 2, got %+v", vs)
+	}
+	stale.Name = "c"
+	err = d.Set(stale)
+	if conflict, ok := err.(ErrConflict); !ok || !reflect.DeepEqual(conflict.Current, vs) {
+		t.Errorf("Wanted a conflict with %+v, got %v", vs, err)
+	}
+	if stale.Version != 1 {
+		t.Errorf("Wanted the stale version to be unchanged, got %+v", stale)
+	}
+	found := &versionedStruct{Id: vs.Id}
+	if err := d.Get(found); err != nil || !reflect.DeepEqual(found, vs) {
+		t.Errorf("Wanted %+v, got %+v, %v", vs, found, err)
+	}
+	other := &versionedStruct{Name: "d"}
+	if err := d.Set(other); err != nil {
+		t.Fatalf(err.Error())
+	}
+	other.Name = "b"
+	if err := d.Set(other); err == nil {
+		t.Errorf("Wanted a unique violation")
+	}
+	if other.Version != 1 {
+		t.Errorf("Wanted the version to be unchanged after a failed Set, got %+v", other)
+	}
+	other.Name = "e"
+	if err := d.Set(other); err != nil || other.Version != 2 {
+		t.Errorf("Wanted version 2, got %+v, %v", other, err)
+	}
+	if err := d.Del(vs); err != nil {
+		t.Fatalf(err.Error())
+	}
+	if err := d.Set(vs); err == nil {
+		t.Errorf("Wanted a conflict when saving a deleted object")
+	} else if conflict, ok := err.(ErrConflict); !ok || conflict.Current != nil {
+		t.Errorf("Wanted a conflict without current object, got %v", err)
+	}
+}
+
+type softStruct struct {
+	Id        []byte
+	Name      string `kol:"index"`
+	DeletedAt time.Time
+}
+
+func TestSoftDelete(t *testing.T) {
+	d, err := New("test")
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	d.Clear()
+	defer d.Close()
+	var all []*softStruct
+	for _, name := range []string{"a", "b", "c"} {
+		ss := &softStruct{Name: name}
+		if err := d.Set(ss); err != nil {
+			t.Fatalf(err.Error())
+		}
+		all = append(all, ss)
+	}
+	ops := make(chan Operation, 10)
+	sub, err := d.Query().Where(Equals{"Name", "b"}).Subscription("softtest", &softStruct{}, AllOps, func(obj interface{}, op Operation) error {
+		ops <- op
+		return nil
+	})
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	sub.Subscribe()
+	if err := d.Del(all[1]); err != nil {
+		t.Fatalf(err.Error())
+	}
+	if op := <-ops; op != Delete {
+		t.Errorf("Wanted a Delete, got %v", op)
+	}
+	if all[1].DeletedAt.IsZero() {
+		t.Errorf("Wanted DeletedAt to be set, got %+v", all[1])
+	}
+	found := &softStruct{Id: all[1].Id}
+	if err := d.Get(found); err != nil || found.DeletedAt.IsZero() {
+		t.Errorf("Wanted a soft deleted object, got %+v, %v", found, err)
+	}
+	assertNames := func(query *Query, wanted []string) {
+		var res []softStruct
+		if err := query.OrderBy("Name").All(&res); err != nil {
+			t.Fatalf(err.Error())
+		}
+		var names []string
+		for _, ss := range res {
+			names = append(names, ss.Name)
+		}
+		if !reflect.DeepEqual(names, wanted) {
+			t.Errorf("Wanted %v, got %v", wanted, names)
+		}
+		if count, err := query.Count(&softStruct{}); err != nil || count != len(wanted) {
+			t.Errorf("Wanted %v matches, got %v, %v", len(wanted), count, err)
+		}
+	}
+	assertNames(d.Query(), []string{"a", "c"})
+	assertNames(d.Query().Where(Equals{"Name", "b"}), nil)
+	assertNames(d.Query().Where(Equals{"Name", "b"}).WithDeleted(), []string{"b"})
+	assertNames(d.Query().WithDeleted(), []string{"a", "b", "c"})
+	if err := d.Del(all[1]); err != NotFound {
+		t.Errorf("Wanted NotFound when deleting twice, got %v", err)
+	}
+	if err := d.Undelete(all[1]); err != nil {
+		t.Fatalf(err.Error())
+	}
+	if op := <-ops; op != Create {
+		t.Errorf("Wanted a Create, got %v", op)
+	}
+	if !all[1].DeletedAt.IsZero() {
+		t.Errorf("Wanted DeletedAt to be zero, got %+v", all[1])
+	}
+	if err := d.Undelete(all[1]); err != NotFound {
+		t.Errorf("Wanted NotFound when undeleting twice, got %v", err)
+	}
+	assertNames(d.Query(), []string{"a", "b", "c"})
+	if err := d.Del(all[0]); err != nil {
+		t.Fatalf(err.Error())
+	}
+	if purged, err := d.Purge(&softStruct{}, all[0].DeletedAt); err != nil || purged != 0 {
+		t.Errorf("Wanted nothing purged, got %v, %v", purged, err)
+	}
+	if purged, err := d.Purge(&softStruct{}, time.Now()); err != nil || purged != 1 {
+		t.Errorf("Wanted one object purged, got %v, %v", purged, err)
+	}
+	if err := d.Get(&softStruct{Id: all[0].Id}); err != NotFound {
+		t.Errorf("Wanted NotFound for purged object, got %v", err)
+	}
+	assertNames(d.Query().WithDeleted(), []string{"b", "c"})
+	typ := reflect.TypeOf(softStruct{})
+	if count := d.db.CountCollection(kc.Keyify(secondaryIndex, typeName(typ))); count != 2 {
+		t.Errorf("Wanted 2 index entries, got %v", count)
+	}
+	if count := d.db.CountCollection(kc.Keyify(softDeleted, typeName(typ))); count != 0 {
+		t.Errorf("Wanted no soft deleted entries, got %v", count)
+	}
+}
+
+type historyStruct struct {
+	Id      []byte
+	Name    string `kol:"index"`
+	Version int
+}
+
+func TestHistory(t *testing.T) {
+	d, err := New("test")
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	d.Clear()
+	defer d.Close()
+	if err := d.KeepHistory(&historyStruct{}); err != nil {
+		t.Fatalf(err.Error())
+	}
+	before := time.Now()
+	hs := &historyStruct{Name: "first"}
+	if err := d.As("alice").Set(hs); err != nil {
+		t.Fatalf(err.Error())
+	}
+	hs.Name = "second"
+	if err := d.As("bob").Set(hs); err != nil {
+		t.Fatalf(err.Error())
+	}
+	revisions, err := d.Revisions(&historyStruct{Id: hs.Id})
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	if len(revisions) != 2 || revisions[0].Principal != "alice" || revisions[1].Principal != "bob" || revisions[0].Deleted || !revisions[0].At.Before(revisions[1].At) {
+		t.Fatalf("Wanted two revisions by alice and bob, got %+v", revisions)
+	}
+	found := &historyStruct{Id: hs.Id}
+	if err := d.GetAt(found, before); err != NotFound {
+		t.Errorf("Wanted NotFound before creation, got %+v, %v", found, err)
+	}
+	if err := d.GetAt(found, revisions[0].At); err != nil || found.Name != "first" || found.Version != 1 {
+		t.Errorf("Wanted the first version, got %+v, %v", found, err)
+	}
+	if err := d.GetAt(found, time.Now()); err != nil || !reflect.DeepEqual(found, hs) {
+		t.Errorf("Wanted %+v, got %+v, %v", hs, found, err)
+	}
+	reverted := &historyStruct{Id: hs.Id}
+	if err := d.Revert(reverted, revisions[0].At); err != nil {
+		t.Fatalf(err.Error())
+	}
+	if reverted.Name != "first" || reverted.Version != 3 {
+		t.Errorf("Wanted the first name with version 3, got %+v", reverted)
+	}
+	var res []historyStruct
+	if err := d.Query().Where(Equals{"Name", "first"}).All(&res); err != nil || len(res) != 1 {
+		t.Errorf("Wanted the reverted object to be indexed, got %+v, %v", res, err)
+	}
+	if err := d.Del(reverted); err != nil {
+		t.Fatalf(err.Error())
+	}
+	if revisions, err = d.Revisions(&historyStruct{Id: hs.Id}); err != nil || len(revisions) != 4 || !revisions[3].Deleted {
+		t.Errorf("Wanted four revisions, the last deleting, got %+v, %v", revisions, err)
+	}
+	if err := d.GetAt(found, time.Now()); err != NotFound {
+		t.Errorf("Wanted NotFound after deletion, got %v", err)
+	}
+	if err := d.Revert(reverted, revisions[1].At); err != nil {
+		t.Fatalf(err.Error())
+	}
+	found = &historyStruct{Id: hs.Id}
+	if err := d.Get(found); err != nil || found.Name != "second" || found.Version != 1 {
+		t.Errorf("Wanted the second name to be restored, got %+v, %v", found, err)
+	}
+	other := &testStruct{Name: "nohistory"}
+	if err := d.Set(other); err != nil {
+		t.Fatalf(err.Error())
+	}
+	if revisions, err := d.Revisions(other); err != nil || len(revisions) != 0 {
+		t.Errorf("Wanted no revisions, got %+v, %v", revisions, err)
+	}
+	if err := d.KeepHistory(&testStruct{}); err != nil {
+		t.Fatalf(err.Error())
+	}
+	beforeChange := time.Now()
+	changed := &testStruct{Id: other.Id, Name: "changed"}
+	if err := d.Set(changed); err != nil {
+		t.Fatalf(err.Error())
+	}
+	foundOther := &testStruct{Id: other.Id}
+	if err := d.GetAt(foundOther, beforeChange); err != nil || foundOther.Name != "nohistory" {
+		t.Errorf("Wanted the version from before the history was kept, got %+v, %v", foundOther, err)
+	}
+	if err := d.GetAt(foundOther, time.Now()); err != nil || foundOther.Name != "changed" {
+		t.Errorf("Wanted the changed version, got %+v, %v", foundOther, err)
+	}
+}
+
+func TestIdGenerators(t *testing.T) {
+	d, err := New("test")
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	d.Clear()
+	defer d.Close()
+	ts := &testStruct{}
+	if err := d.Set(ts); err != nil || len(ts.Id) != 24 {
+		t.Errorf("Wanted a 24 byte Id, got %v, %v", ts.Id, err)
+	}
+	d.SetIdGenerator(RandomIds{Length: 8})
+	ts = &testStruct{}
+	if err := d.Set(ts); err != nil || len(ts.Id) != 8 {
+		t.Errorf("Wanted an 8 byte Id, got %v, %v", ts.Id, err)
+	}
+	d.SetIdGenerator(&TimeOrderedIds{})
+	if err := d.SetTypeIdGenerator(&compositeStruct{}, SequenceIds{}); err != nil {
+		t.Fatalf(err.Error())
+	}
+	var ordered [][]byte
+	for i := 0; i < 100; i++ {
+		ts := &testStruct{Age: i}
+		if err := d.Set(ts); err != nil {
+			t.Fatalf(err.Error())
+		}
+		if len(ts.Id) != 16 {
+			t.Fatalf("Wanted a 16 byte Id, got %v", ts.Id)
+		}
+		ordered = append(ordered, ts.Id)
+		cs := &compositeStruct{Age: i}
+		if err := d.Set(cs); err != nil {
+			t.Fatalf(err.Error())
+		}
+		if seq, err := SequenceId(cs.Id); err != nil || seq != uint64(i+1) {
+			t.Errorf("Wanted sequence %v, got %v, %v", i+1, seq, err)
+		}
+	}
+	for i := 1; i < len(ordered); i++ {
+		if bytes.Compare(ordered[i-1], ordered[i]) >= 0 {
+			t.Fatalf("Wanted %v before %v", ordered[i-1], ordered[i])
+		}
+	}
+	var res []testStruct
+	if err := d.Query().Where(GreaterOrEqual{"Age", 0}).All(&res); err != nil {
+		t.Fatalf(err.Error())
+	}
+	var ages []int
+	for _, ts := range res {
+		if len(ts.Id) == 16 {
+			ages = append(ages, ts.Age)
+		}
+	}
+	for i, age := range ages {
+		if age != i {
+			t.Fatalf("Wanted records in creation order, got ages %v", ages)
+		}
+	}
+	if _, err := SequenceId(ordered[0]); err == nil {
+		t.Errorf("Wanted an error for a time ordered Id")
+	}
+}
+
+func TestMulti(t *testing.T) {
+	d, err := New("test")
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	d.Clear()
+	defer d.Close()
+	created := make(chan bool, 10)
+	sub, err := d.Query().Subscription("multitest", &versionedStruct{}, Create, func(obj interface{}, op Operation) error {
+		created <- true
+		return nil
+	})
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	sub.Subscribe()
+	items := []versionedStruct{{Name: "a"}, {Name: "b"}, {Name: "a"}, {Name: "c"}}
+	err = d.SetMulti(items, 0)
+	if multiErr, ok := err.(MultiError); !ok || len(multiErr) != 4 || multiErr[0] != nil || multiErr[1] != nil || multiErr[3] != nil {
+		t.Fatalf("Wanted a MultiError for the third item, got %v", err)
+	} else if _, ok := multiErr[2].(ErrUniqueViolation); !ok {
+		t.Errorf("Wanted a unique violation, got %v", multiErr[2])
+	}
+	for index, vs := range items {
+		if index == 2 {
+			if vs.Id != nil || vs.Version != 0 {
+				t.Errorf("Wanted the failed item to be unchanged, got %+v", vs)
+			}
+		} else if vs.Id == nil || vs.Version != 1 {
+			t.Errorf("Wanted item %v to be saved, got %+v", index, vs)
+		}
+	}
+	for i := 0; i < 3; i++ {
+		select {
+		case <-created:
+		case <-time.After(time.Second):
+			t.Fatalf("Wanted 3 Create events, got %v", i)
+		}
+	}
+	pointers := []*versionedStruct{{Name: "d"}, {Name: "e"}, {Name: "f"}}
+	if err := d.SetMulti(pointers, 2); err != nil {
+		t.Fatalf(err.Error())
+	}
+	if count, err := d.Query().Count(&versionedStruct{}); err != nil || count != 6 {
+		t.Errorf("Wanted 6 items, got %v, %v", count, err)
+	}
+	if msg := make(MultiError, 3).Error(); msg != "0 of 3 items failed" {
+		t.Errorf("Wanted a message for no failed items, got %q", msg)
+	}
+	if err := d.SetMulti(items[0], 0); err == nil {
+		t.Errorf("Wanted an error for a non slice")
+	}
+	found := []versionedStruct{{Id: items[0].Id}, {Id: pointers[2].Id}, {Id: []byte("missing")}}
+	err = d.GetMulti(found)
+	if multiErr, ok := err.(MultiError); !ok || multiErr[0] != nil || multiErr[1] != nil || multiErr[2] != NotFound {
+		t.Errorf("Wanted NotFound for the third item, got %v", err)
+	}
+	if !reflect.DeepEqual(found[0], items[0]) || !reflect.DeepEqual(&found[1], pointers[2]) {
+		t.Errorf("Wanted %+v and %+v, got %+v", items[0], pointers[2], found)
+	}
+	err = d.DelMulti(found, 0)
+	if multiErr, ok := err.(MultiError); !ok || multiErr[0] != nil || multiErr[1] != nil || multiErr[2] != NotFound {
+		t.Errorf("Wanted NotFound for the third item, got %v", err)
+	}
+	if count, err := d.Query().Count(&versionedStruct{}); err != nil || count != 4 {
+		t.Errorf("Wanted 4 items, got %v, %v", count, err)
+	}
+	items = []versionedStruct{{Name: "g"}, {Name: "b"}, {Name: "h"}, {Name: "c"}, {Name: "h"}, {Name: "i"}}
+	err = d.SetMulti(items, 0)
+	if multiErr, ok := err.(MultiError); !ok {
+		t.Fatalf("Wanted a MultiError, got %v", err)
+	} else {
+		for index, itemErr := range multiErr {
+			if failed := index == 1 || index == 3 || index == 4; failed != (itemErr != nil) {
+				t.Errorf("Wanted item %v to fail: %v, got %v", index, failed, itemErr)
+			}
+		}
+	}
+	if count, err := d.Query().Count(&versionedStruct{}); err != nil || count != 7 {
+		t.Errorf("Wanted 7 items, got %v, %v", count, err)
+	}
+	if err := d.Transact(func(d *DB) error {
+		return d.SetMulti([]versionedStruct{{Name: "j"}}, 0)
+	}); err == nil {
+		t.Errorf("Wanted an error for SetMulti inside a transaction")
+	}
+	if count, err := d.Query().Where(Equals{"Name", "j"}).Count(&versionedStruct{}); err != nil || count != 0 {
+		t.Errorf("Wanted no items from SetMulti inside a transaction, got %v, %v", count, err)
+	}
+}
+
+type patchAddress struct {
+	City string
+	Zip  int
+}
+
+type patchStruct struct {
+	Id        []byte
+	Name      string `kol:"index"`
+	Email     string `kol:"unique"`
+	Bio       string `kol:"fulltext"`
+	Age       int    `json:"age"`
+	Tags      map[string]string
+	Address   patchAddress
+	Version   int
+	UpdatedAt time.Time
+}
+
+func TestUpdateAndPatch(t *testing.T) {
+	d, err := New("test")
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	d.Clear()
+	defer d.Close()
+	ps := &patchStruct{
+		Name:    "a",
+		Email:   "a@x",
+		Bio:     "hello world",
+		Age:     1,
+		Tags:    map[string]string{"k": "v", "x": "y"},
+		Address: patchAddress{City: "c1", Zip: 1},
+	}
+	if err := d.Set(ps); err != nil {
+		t.Fatalf(err.Error())
+	}
+	updates := make(chan *patchStruct, 10)
+	sub, err := d.Query().Subscription("patchtest", &patchStruct{}, Update, func(obj interface{}, op Operation) error {
+		updates <- obj.(*patchStruct)
+		return nil
+	})
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	sub.Subscribe()
+	countNames := func(name string) int {
+		count, err := d.Query().Where(Equals{"Name", name}).Count(&patchStruct{})
+		if err != nil {
+			t.Fatalf(err.Error())
+		}
+		return count
+	}
+	updated := &patchStruct{Id: ps.Id, Name: "b", Age: 99}
+	if err := d.Update(updated, "Name"); err != nil {
+		t.Fatalf(err.Error())
+	}
+	if updated.Name != "b" || updated.Age != 1 || updated.Email != "a@x" || updated.Version != 2 || !updated.UpdatedAt.After(ps.UpdatedAt) {
+		t.Errorf("Wanted only the name to be updated, got %+v", updated)
+	}
+	if countNames("a") != 0 || countNames("b") != 1 {
+		t.Errorf("Wanted the name index to be updated")
+	}
+	if got := <-updates; got.Name != "b" {
+		t.Errorf("Wanted an update with the new name, got %+v", got)
+	}
+	patched := &patchStruct{Id: ps.Id}
+	if err := d.Patch(patched, map[string]interface{}{
+		"Bio":     "goodbye moon",
+		"Address": map[string]interface{}{"Zip": 2},
+		"Tags":    map[string]interface{}{"x": nil, "z": "w"},
+	}); err != nil {
+		t.Fatalf(err.Error())
+	}
+	if patched.Bio != "goodbye moon" || !reflect.DeepEqual(patched.Address, patchAddress{City: "c1", Zip: 2}) || !reflect.DeepEqual(patched.Tags, map[string]string{"k": "v", "z": "w"}) || patched.Name != "b" || patched.Version != 3 {
+		t.Errorf("Wanted a patched object, got %+v", patched)
+	}
+	for text, wanted := range map[string]int{"moon": 1, "hello": 0} {
+		if count, err := d.Query().Where(Match{"Bio", text}).Count(&patchStruct{}); err != nil || count != wanted {
+			t.Errorf("Wanted %v matches for %v, got %v, %v", wanted, text, count, err)
+		}
+	}
+	<-updates
+	if err := d.PatchJSON(patched, []byte(`{"age": null, "email": "b@x"}`)); err != nil {
+		t.Fatalf(err.Error())
+	}
+	if patched.Age != 0 || patched.Email != "b@x" {
+		t.Errorf("Wanted a reset age and a new email, got %+v", patched)
+	}
+	<-updates
+	found := &patchStruct{}
+	if err := d.GetUnique(found, "Email", "b@x"); err != nil || !reflect.DeepEqual(found.Id, ps.Id) {
+		t.Errorf("Wanted %v, got %+v, %v", ps.Id, found, err)
+	}
+	other := &patchStruct{Name: "other", Email: "a@x"}
+	if err := d.Set(other); err != nil {
+		t.Fatalf(err.Error())
+	}
+	if err := d.PatchJSON(&patchStruct{Id: ps.Id}, []byte(`{"Email": "a@x"}`)); err == nil {
+		t.Errorf("Wanted a unique violation")
+	} else if _, ok := err.(ErrUniqueViolation); !ok {
+		t.Errorf("Wanted a unique violation, got %v", err)
+	}
+	for _, patch := range []string{`{"Id": "AAAA"}`, `{"Nope": 1}`, `{"Age": "old"}`} {
+		if err := d.PatchJSON(&patchStruct{Id: ps.Id}, []byte(patch)); err == nil {
+			t.Errorf("Wanted an error for %v", patch)
+		}
+	}
+	found = &patchStruct{Id: ps.Id}
+	if err := d.Get(found); err != nil || !found.UpdatedAt.Equal(patched.UpdatedAt) {
+		t.Errorf("Wanted %v, got %+v, %v", patched.UpdatedAt, found, err)
+	}
+	found.UpdatedAt = patched.UpdatedAt
+	if !reflect.DeepEqual(found, patched) {
+		t.Errorf("Wanted %+v to be unchanged, got %+v", patched, found)
+	}
+	if err := d.Update(&patchStruct{Id: []byte("missing")}, "Name"); err != NotFound {
+		t.Errorf("Wanted NotFound, got %v", err)
+	}
+	if count := d.db.CountCollection(kc.Keyify(secondaryIndex, typeName(reflect.TypeOf(patchStruct{})))); count != 4 {
+		t.Errorf("Wanted 4 index entries, got %v", count)
+	}
+}
+
+type nilPathInner struct {
+	C string `kol:"index"`
+}
+
+type nilPathStruct struct {
+	Id []byte
+	A  string `kol:"index,composite<A+B+P.C>"`
+	B  string `kol:"index"`
+	P  *nilPathInner
+}
+
+func TestNilPaths(t *testing.T) {
+	d, err := New("test")
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	d.Clear()
+	defer d.Close()
+	for _, c := range []string{"c2", "", "c1", "", "c3"} {
+		nps := &nilPathStruct{A: "a", B: "b"}
+		if c != "" {
+			nps.P = &nilPathInner{C: c}
+		}
+		if err := d.Set(nps); err != nil {
+			t.Fatalf(err.Error())
+		}
+	}
+	typ := reflect.TypeOf(nilPathStruct{})
+	filter := And{Equals{"A", "a"}, Equals{"B", "b"}}
+	if _, _, planned, err := filter.compositeSource(d, typ); err != nil || planned {
+		t.Errorf("Wanted no composite plan when uncovered fields may be nil, got %v, %v", planned, err)
+	}
+	if count, err := d.Query().Where(filter).Count(&nilPathStruct{}); err != nil || count != 5 {
+		t.Errorf("Wanted 5 matches, got %v, %v", count, err)
+	}
+	if _, _, planned, err := append(filter, Equals{"P.C", "c1"}).compositeSource(d, typ); err != nil || !planned {
+		t.Errorf("Wanted a composite plan when all fields are covered, got %v, %v", planned, err)
+	}
+	cs := func(res []nilPathStruct) (result []string) {
+		for _, nps := range res {
+			if nps.P == nil {
+				result = append(result, "")
+			} else {
+				result = append(result, nps.P.C)
+			}
+		}
+		return
+	}
+	for _, test := range []struct {
+		query  func() *Query
+		wanted []string
+	}{
+		{func() *Query { return d.Query().OrderBy("P.C") }, []string{"c1", "c2", "c3", "", ""}},
+		{func() *Query { return d.Query().OrderByDesc("P.C") }, []string{"", "", "c3", "c2", "c1"}},
+		{func() *Query { return d.Query().Where(Equals{"A", "a"}).OrderBy("P.C") }, []string{"c1", "c2", "c3", "", ""}},
+	} {
+		var res []nilPathStruct
+		if err := test.query().All(&res); err != nil {
+			t.Fatalf(err.Error())
+		}
+		if found := cs(res); !reflect.DeepEqual(found, test.wanted) {
+			t.Errorf("Wanted %v, got %v", test.wanted, found)
+		}
+		var paged []string
+		token := ""
+		for i := 0; i < 10; i++ {
+			res = nil
+			next, err := test.query().After(token).Limit(2).Page(&res)
+			if err != nil {
+				t.Fatalf(err.Error())
+			}
+			paged = append(paged, cs(res)...)
+			if next == "" {
+				break
+			}
+			token = next
+		}
+		if !reflect.DeepEqual(paged, test.wanted) {
+			t.Errorf("Wanted pages of %v, got %v", test.wanted, paged)
+		}
+	}
+}
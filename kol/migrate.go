@@ -0,0 +1,378 @@
+package kol
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"reflect"
+	"sort"
+	"sync"
+
+	"github.com/zond/kcwraps/kc"
+)
+
+const (
+	meta            = "meta"
+	fingerprintMeta = "fingerprint"
+	versionMeta     = "version"
+	progressMeta    = "progress"
+	migrationBatch  = 256
+	// indexFormat must be increased when the encoding of index entries changes, so that EnsureIndexes reindexes the
+	// records. Records indexed in an older format, or before index layouts were tracked, can still be changed, but
+	// queries on their indexed fields may miss them until they are reindexed.
+	indexFormat = 3
+)
+
+/*
+fingerprint returns a hash of everything deciding the index entries of records of typ: the kol tags of its fields,
+its registered composite indices and the format of the entries.
+*/
+func fingerprint(typ reflect.Type) string {
+	h := sha1.New()
+	fmt.Fprintf(h, "index format %v\n", indexFormat)
+	for _, field := range taggedFields(typ) {
+		fmt.Fprintf(h, "%v %v %q\n", field.path, field.typ, field.tag)
+	}
+	for _, c := range composites(typ) {
+		fmt.Fprintf(h, "composite %v\n", c.name())
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+/*
+eachBatch calls f with all records of typ, or all records after the one with the Id after if it is not nil, in
+transactions of at most migrationBatch records each.
+*/
+func (self *DB) eachBatch(typ reflect.Type, after []byte, f func(self *DB, id []byte, b []byte) error) (err error) {
+	keys := kc.Keyify(primaryKey, typeName(typ))
+	prefix := kc.JoinKeys(keys)
+	jump := prefix
+	if after != nil {
+		jump = append(kc.JoinKeys(kc.Keyify(primaryKey, typeName(typ), after)), 0)
+	}
+	for {
+		var batch []kc.KV
+		cursor := self.db.Cursor()
+		err = cursor.KCCUR.JumpKey(jump)
+		for err == nil && len(batch) < migrationBatch {
+			var key, value []byte
+			if key, value, err = cursor.KCCUR.Get(true); err != nil {
+				break
+			}
+			if !bytes.HasPrefix(key, prefix) {
+				break
+			}
+			batch = append(batch, kc.KV{
+				Keys:  kc.SplitKeys(key),
+				Value: value,
+			})
+			// The key directly after key
+			jump = append(key, 0)
+		}
+		if err != nil && err.Error() != kc.NoRecord {
+			return
+		}
+		err = nil
+		if len(batch) == 0 {
+			return
+		}
+		if err = self.Transact(func(self *DB) (err error) {
+			for _, kv := range batch {
+				if err = f(self, kv.Keys[len(keys)], kv.Value); err != nil {
+					return
+				}
+			}
+			return
+		}); err != nil {
+			return
+		}
+	}
+}
+
+/*
+checkUniques returns an ErrUniqueViolation if the stored records of typ don't satisfy the unique constraints of typ.
+*/
+func (self *DB) checkUniques(typ reflect.Type) (err error) {
+	if len(uniques(typ)) == 0 {
+		return
+	}
+	claimed := make(map[string][]byte)
+	return self.eachBatch(typ, nil, func(self *DB, id []byte, b []byte) (err error) {
+		obj := reflect.New(typ)
+		if err = self.decode(b, obj.Interface()); err != nil {
+			return
+		}
+		for _, c := range uniques(typ) {
+			var keys [][]byte
+			if keys, err = uniqueKey(obj.Elem(), typ, c); err != nil {
+				return
+			}
+			if keys == nil {
+				continue
+			}
+			key := string(kc.JoinKeys(keys))
+			if existing, found := claimed[key]; found {
+				return ErrUniqueViolation{
+					Field: c.name(),
+					Id:    Id(existing),
+				}
+			}
+			claimed[key] = id
+		}
+		return
+	})
+}
+
+/*
+Reindex will remove all index entries for the type of obj, and rebuild them from the stored records, in transactions
+of a limited number of records each. Queries running during the rebuild may miss records not yet reindexed.
+
+Returns an ErrUniqueViolation without changing anything if the records don't satisfy the unique constraints of the type.
+If the rebuild fails anyway, the records not yet reindexed can still be changed, but queries may miss them until
+Reindex succeeds.
+
+Obj must be a pointer to a struct having a []byte Id field.
+*/
+func (self *DB) Reindex(obj interface{}) (err error) {
+	var value reflect.Value
+	if value, _, err = identify(obj); err != nil {
+		return
+	}
+	typ := value.Type()
+	if err = self.checkUniques(typ); err != nil {
+		return
+	}
+	if err = self.Transact(func(self *DB) (err error) {
+		for _, space := range []string{secondaryIndex, nilIndex, foreignIndex, compositeIndex, uniqueIndex, fulltextIndex, softDeleted} {
+			if err = self.db.ClearAll(kc.Keyify(space, typeName(typ))); err != nil {
+				return
+			}
+		}
+		return
+	}); err != nil {
+		return
+	}
+	if err = self.eachBatch(typ, nil, func(self *DB, id []byte, b []byte) (err error) {
+		obj := reflect.New(typ)
+		if err = self.decode(b, obj.Interface()); err != nil {
+			return
+		}
+		return self.index(id, obj.Elem(), typ)
+	}); err != nil {
+		return
+	}
+	return self.db.Set(kc.Keyify(meta, typeName(typ), fingerprintMeta), []byte(fingerprint(typ)))
+}
+
+/*
+IndexesChanged will return whether the index layout of the type of obj, i.e. its kol tags and composite indices,
+has changed since it was last indexed by Reindex or EnsureIndexes.
+
+Obj must be a pointer to a struct having a []byte Id field.
+*/
+func (self *DB) IndexesChanged(obj interface{}) (result bool, err error) {
+	var value reflect.Value
+	if value, _, err = identify(obj); err != nil {
+		return
+	}
+	typ := value.Type()
+	var stored []byte
+	if stored, err = self.db.Get(kc.Keyify(meta, typeName(typ), fingerprintMeta)); err != nil {
+		if err.Error() != kc.NoRecord {
+			return
+		}
+		err = nil
+		// Unknown layouts have changed, unless there are no records to index
+		result = self.db.HasCollection(kc.Keyify(primaryKey, typeName(typ)))
+		return
+	}
+	result = string(stored) != fingerprint(typ)
+	return
+}
+
+/*
+EnsureIndexes will Reindex the types of all objs whose index layouts have changed, and is suitable to run at startup.
+
+All objs must be pointers to structs having []byte Id fields.
+*/
+func (self *DB) EnsureIndexes(objs ...interface{}) (err error) {
+	for _, obj := range objs {
+		var changed bool
+		if changed, err = self.IndexesChanged(obj); err != nil {
+			return
+		}
+		if changed {
+			if err = self.Reindex(obj); err != nil {
+				return
+			}
+		} else {
+			var value reflect.Value
+			if value, _, err = identify(obj); err != nil {
+				return
+			}
+			if err = self.db.Set(kc.Keyify(meta, typeName(value.Type()), fingerprintMeta), []byte(fingerprint(value.Type()))); err != nil {
+				return
+			}
+		}
+	}
+	return
+}
+
+/*
+Migration transforms a stored object, decoded into a pointer to its type, to the next version of its type.
+*/
+type Migration func(obj interface{}) error
+
+type migration struct {
+	version int
+	migrate Migration
+}
+
+type migrations struct {
+	lock  *sync.RWMutex
+	types map[reflect.Type][]migration
+}
+
+func newMigrations() *migrations {
+	return &migrations{
+		lock:  new(sync.RWMutex),
+		types: make(map[reflect.Type][]migration),
+	}
+}
+
+/*
+RegisterMigration will make Migrate run migrate on all stored objects of the type of obj, if the stored
+version of the type is below version.
+*/
+func (self *DB) RegisterMigration(obj interface{}, version int, migrate Migration) {
+	typ := reflect.TypeOf(obj)
+	for typ.Kind() == reflect.Ptr {
+		typ = typ.Elem()
+	}
+	self.migrations.lock.Lock()
+	defer self.migrations.lock.Unlock()
+	self.migrations.types[typ] = append(self.migrations.types[typ], migration{
+		version: version,
+		migrate: migrate,
+	})
+	sort.Sort(migrationsByVersion(self.migrations.types[typ]))
+}
+
+type migrationsByVersion []migration
+
+func (self migrationsByVersion) Len() int           { return len(self) }
+func (self migrationsByVersion) Less(i, j int) bool { return self[i].version < self[j].version }
+func (self migrationsByVersion) Swap(i, j int)      { self[i], self[j] = self[j], self[i] }
+
+/*
+SchemaVersion will return the version of the stored objects of the type of obj, i.e. the version of the last
+migration run by Migrate, or 0.
+
+Obj must be a pointer to a struct having a []byte Id field.
+*/
+func (self *DB) SchemaVersion(obj interface{}) (result int, err error) {
+	var value reflect.Value
+	if value, _, err = identify(obj); err != nil {
+		return
+	}
+	var b []byte
+	if b, err = self.db.Get(kc.Keyify(meta, typeName(value.Type()), versionMeta)); err != nil {
+		if err.Error() == kc.NoRecord {
+			err = nil
+		}
+		return
+	}
+	result = int(binary.BigEndian.Uint64(b))
+	return
+}
+
+/*
+Migrate will run the registered migrations of the type of obj with versions above its SchemaVersion, in order of
+version, on all stored objects of the type, and then store the new version.
+
+Each migration runs in transactions of a limited number of objects each, and records the last migrated object in the
+same transactions, so if a migration fails the next Migrate continues after the objects it already migrated. Migrate
+runs EnsureIndexes before the migrations, and the migrated objects are reindexed, but their UpdatedAt fields are not
+changed and no subscribers are notified.
+
+Obj must be a pointer to a struct having a []byte Id field.
+*/
+func (self *DB) Migrate(obj interface{}) (err error) {
+	var value reflect.Value
+	if value, _, err = identify(obj); err != nil {
+		return
+	}
+	typ := value.Type()
+	var version int
+	if version, err = self.SchemaVersion(obj); err != nil {
+		return
+	}
+	var pending []migration
+	self.migrations.lock.RLock()
+	for _, m := range self.migrations.types[typ] {
+		if m.version > version {
+			pending = append(pending, m)
+		}
+	}
+	self.migrations.lock.RUnlock()
+	if len(pending) == 0 {
+		return
+	}
+	// Make sure the old index entries of the objects exist, so that they can be removed
+	if err = self.EnsureIndexes(obj); err != nil {
+		return
+	}
+	progressKeys := kc.Keyify(meta, typeName(typ), progressMeta)
+	for _, m := range pending {
+		// The progress is the version of the unfinished migration followed by the Id of the last migrated object
+		var after []byte
+		var progress []byte
+		if progress, err = self.db.Get(progressKeys); err != nil {
+			if err.Error() != kc.NoRecord {
+				return
+			}
+			err = nil
+		} else if int(binary.BigEndian.Uint64(progress)) == m.version {
+			after = progress[8:]
+		}
+		if err = self.eachBatch(typ, after, func(self *DB, id []byte, b []byte) (err error) {
+			old := reflect.New(typ)
+			if err = self.decode(b, old.Interface()); err != nil {
+				return
+			}
+			obj := reflect.New(typ)
+			if err = self.decode(b, obj.Interface()); err != nil {
+				return
+			}
+			if err = m.migrate(obj.Interface()); err != nil {
+				return
+			}
+			if err = self.deIndex(id, old.Elem(), typ); err != nil {
+				return
+			}
+			if err = self.index(id, obj.Elem(), typ); err != nil {
+				return
+			}
+			if err = self.save(id, typ, obj.Interface()); err != nil {
+				return
+			}
+			return self.db.Set(progressKeys, append(uint64Bytes(uint64(m.version)), id...))
+		}); err != nil {
+			return
+		}
+		if err = self.Transact(func(self *DB) (err error) {
+			if err = self.db.Set(kc.Keyify(meta, typeName(typ), versionMeta), uint64Bytes(uint64(m.version))); err != nil {
+				return
+			}
+			if err = self.db.Remove(progressKeys); err != nil && err.Error() == kc.NoRecord {
+				err = nil
+			}
+			return
+		}); err != nil {
+			return
+		}
+	}
+	return
+}
@@ -0,0 +1,189 @@
+package kol
+
+import (
+	"fmt"
+	"reflect"
+)
+
+/*
+MultiError is returned by bulk operations when some of the items failed, and contains the errors of the items at the
+same indices as the items, nil for the items that succeeded.
+*/
+type MultiError []error
+
+func (self MultiError) Error() string {
+	count, first := 0, -1
+	for index, err := range self {
+		if err != nil {
+			if first == -1 {
+				first = index
+			}
+			count++
+		}
+	}
+	if first == -1 {
+		return fmt.Sprintf("0 of %v items failed", len(self))
+	}
+	return fmt.Sprintf("%v of %v items failed, item %v with %v", count, len(self), first, self[first])
+}
+
+// multiItems returns pointers to the structs in objs, which must be a slice of structs or struct pointers.
+func multiItems(objs interface{}) (result []interface{}, err error) {
+	slice := reflect.ValueOf(objs)
+	if slice.Kind() != reflect.Slice {
+		err = fmt.Errorf("%v is not a slice", objs)
+		return
+	}
+	result = make([]interface{}, slice.Len())
+	for index := range result {
+		if elem := slice.Index(index); elem.Kind() == reflect.Ptr {
+			result[index] = elem.Interface()
+		} else {
+			result[index] = elem.Addr().Interface()
+		}
+	}
+	return
+}
+
+/*
+multi runs f for the items of objs, in a transaction for every chunk of chunkSize items, or one transaction for all items
+if chunkSize is 0.
+
+Since a failed item rolls back the whole transaction, multi can't run inside another transaction.
+*/
+func (self *DB) multi(objs interface{}, chunkSize int, f func(db *DB, obj interface{}) error) (err error) {
+	if self.db.InTransaction() {
+		err = fmt.Errorf("Can't run bulk operations inside transactions")
+		return
+	}
+	var items []interface{}
+	if items, err = multiItems(objs); err != nil {
+		return
+	}
+	errs := make(MultiError, len(items))
+	var valid []int
+	for index, obj := range items {
+		if _, _, errs[index] = identify(obj); errs[index] == nil {
+			valid = append(valid, index)
+		}
+	}
+	if chunkSize < 1 {
+		chunkSize = len(valid)
+	}
+	for start := 0; start < len(valid); start += chunkSize {
+		end := start + chunkSize
+		if end > len(valid) {
+			end = len(valid)
+		}
+		if err = self.multiChunk(items, valid[start:end], errs, f); err != nil {
+			return
+		}
+	}
+	for _, itemErr := range errs {
+		if itemErr != nil {
+			err = errs
+			break
+		}
+	}
+	return
+}
+
+/*
+multiChunk runs f for the items with the indices in pending in one transaction.
+
+If f fails for an item, the transaction is rolled back, the items are restored to how they were before the transaction,
+the error is recorded in errs, and the items before the failed item are run in a new transaction before continuing
+with the items after it.
+*/
+func (self *DB) multiChunk(items []interface{}, pending []int, errs MultiError, f func(db *DB, obj interface{}) error) (err error) {
+	for len(pending) > 0 {
+		saved := make([]reflect.Value, len(pending))
+		for index, itemIndex := range pending {
+			value := reflect.ValueOf(items[itemIndex]).Elem()
+			saved[index] = reflect.New(value.Type()).Elem()
+			saved[index].Set(value)
+		}
+		failedIndex := -1
+		if err = self.Transact(func(self *DB) (err error) {
+			for index, itemIndex := range pending {
+				if err = f(self, items[itemIndex]); err != nil {
+					failedIndex = index
+					return
+				}
+			}
+			return
+		}); err == nil {
+			return
+		}
+		for index, itemIndex := range pending {
+			reflect.ValueOf(items[itemIndex]).Elem().Set(saved[index])
+		}
+		if failedIndex == -1 {
+			return
+		}
+		errs[pending[failedIndex]] = err
+		if err = self.multiChunk(items, pending[:failedIndex], errs, f); err != nil {
+			return
+		}
+		pending = pending[failedIndex+1:]
+	}
+	return
+}
+
+/*
+SetMulti will Set all items of objs in a transaction for every chunk of chunkSize items, or in one transaction if
+chunkSize is 0, and notify subscribers after each transaction.
+
+Objs must be a slice of structs, or pointers to structs, having []byte Id fields.
+
+If some items fail, the others are still saved and a MultiError is returned.
+
+Returns an error if the DB is inside a transaction.
+*/
+func (self *DB) SetMulti(objs interface{}, chunkSize int) error {
+	return self.multi(objs, chunkSize, (*DB).Set)
+}
+
+/*
+DelMulti will Del all items of objs in a transaction for every chunk of chunkSize items, or in one transaction if
+chunkSize is 0, and notify subscribers after each transaction.
+
+Objs must be a slice of structs, or pointers to structs, having []byte Id fields.
+
+If some items fail, the others are still deleted and a MultiError is returned.
+
+Returns an error if the DB is inside a transaction.
+*/
+func (self *DB) DelMulti(objs interface{}, chunkSize int) error {
+	return self.multi(objs, chunkSize, (*DB).Del)
+}
+
+/*
+GetMulti will Get all items of objs in one transaction.
+
+Objs must be a slice of structs, or pointers to structs, having []byte Id fields.
+
+If some items fail, for example with NotFound, the others are still loaded and a MultiError is returned.
+*/
+func (self *DB) GetMulti(objs interface{}) (err error) {
+	var items []interface{}
+	if items, err = multiItems(objs); err != nil {
+		return
+	}
+	errs := make(MultiError, len(items))
+	failed := false
+	if err = self.Transact(func(self *DB) (err error) {
+		for index, obj := range items {
+			if errs[index] = self.Get(obj); errs[index] != nil {
+				failed = true
+			}
+		}
+		return
+	}); err != nil {
+		return
+	}
+	if failed {
+		err = errs
+	}
+	return
+}
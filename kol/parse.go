@@ -0,0 +1,505 @@
+package kol
+
+import (
+	"fmt"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+)
+
+// ParseError is returned when a textual query can't be parsed.
+type ParseError struct {
+	// Position is the byte offset in the query where the error was found.
+	Position int
+	Message  string
+}
+
+func (self ParseError) Error() string {
+	return fmt.Sprintf("%v at position %v", self.Message, self.Position)
+}
+
+type tokenKind int
+
+const (
+	endToken tokenKind = iota
+	identToken
+	stringToken
+	numberToken
+	symbolToken
+)
+
+type token struct {
+	kind     tokenKind
+	text     string
+	position int
+}
+
+func (self token) String() string {
+	if self.kind == endToken {
+		return "end of query"
+	}
+	return fmt.Sprintf("%q", self.text)
+}
+
+// is returns whether self is the keyword or symbol s.
+func (self token) is(s string) bool {
+	return (self.kind == identToken || self.kind == symbolToken) && strings.EqualFold(self.text, s)
+}
+
+func lex(text string) (result []token, err error) {
+	runes := []rune(text)
+	// offsets contains the byte offset of each rune, and the length of text
+	offsets := make([]int, 0, len(runes)+1)
+	for offset := range text {
+		offsets = append(offsets, offset)
+	}
+	offsets = append(offsets, len(text))
+	for i := 0; i < len(runes); {
+		r := runes[i]
+		start := i
+		switch {
+		case unicode.IsSpace(r):
+			i++
+			continue
+		case unicode.IsLetter(r) || r == '_':
+			for i < len(runes) && (unicode.IsLetter(runes[i]) || unicode.IsDigit(runes[i]) || runes[i] == '_' || runes[i] == '.') {
+				i++
+			}
+			result = append(result, token{identToken, string(runes[start:i]), offsets[start]})
+		case unicode.IsDigit(r) || (r == '-' && i+1 < len(runes) && (unicode.IsDigit(runes[i+1]) || runes[i+1] == '.')) || (r == '.' && i+1 < len(runes) && unicode.IsDigit(runes[i+1])):
+			i++
+			for i < len(runes) && (unicode.IsDigit(runes[i]) || runes[i] == '.' || runes[i] == 'e' || runes[i] == 'E' || ((runes[i] == '-' || runes[i] == '+') && (runes[i-1] == 'e' || runes[i-1] == 'E'))) {
+				i++
+			}
+			result = append(result, token{numberToken, string(runes[start:i]), offsets[start]})
+		case r == '\'' || r == '"':
+			var value []rune
+			i++
+			for {
+				if i >= len(runes) {
+					err = ParseError{offsets[start], "Unterminated string"}
+					return
+				}
+				if runes[i] == '\\' && i+1 < len(runes) {
+					value = append(value, runes[i+1])
+					i += 2
+					continue
+				}
+				if runes[i] == r {
+					i++
+					break
+				}
+				value = append(value, runes[i])
+				i++
+			}
+			result = append(result, token{stringToken, string(value), offsets[start]})
+		case strings.ContainsRune("(),", r):
+			i++
+			result = append(result, token{symbolToken, string(r), offsets[start]})
+		case strings.ContainsRune("=!<>", r):
+			i++
+			if i < len(runes) && runes[i] == '=' {
+				i++
+			}
+			symbol := string(runes[start:i])
+			if symbol == "!" {
+				err = ParseError{offsets[start], "Unexpected \"!\""}
+				return
+			}
+			result = append(result, token{symbolToken, symbol, offsets[start]})
+		default:
+			err = ParseError{offsets[start], fmt.Sprintf("Unexpected %q", r)}
+			return
+		}
+	}
+	result = append(result, token{endToken, "", len(text)})
+	return
+}
+
+type parser struct {
+	typ    reflect.Type
+	tokens []token
+	next   int
+}
+
+func (self *parser) peek() token {
+	return self.tokens[self.next]
+}
+
+func (self *parser) pop() (result token) {
+	result = self.tokens[self.next]
+	if result.kind != endToken {
+		self.next++
+	}
+	return
+}
+
+// accept pops the next token if it is the keyword or symbol s.
+func (self *parser) accept(s string) bool {
+	if self.peek().is(s) {
+		self.pop()
+		return true
+	}
+	return false
+}
+
+func (self *parser) expect(s string) (err error) {
+	if tok := self.pop(); !tok.is(s) {
+		err = ParseError{tok.position, fmt.Sprintf("Expected %q, got %v", s, tok)}
+	}
+	return
+}
+
+func (self *parser) parseOr() (result QFilter, err error) {
+	var filter QFilter
+	if filter, err = self.parseAnd(); err != nil {
+		return
+	}
+	or := Or{filter}
+	for self.accept("OR") {
+		if filter, err = self.parseAnd(); err != nil {
+			return
+		}
+		or = append(or, filter)
+	}
+	if len(or) == 1 {
+		result = or[0]
+	} else {
+		result = or
+	}
+	return
+}
+
+func (self *parser) parseAnd() (result QFilter, err error) {
+	var filter QFilter
+	if filter, err = self.parseNot(); err != nil {
+		return
+	}
+	and := And{filter}
+	for self.accept("AND") {
+		if filter, err = self.parseNot(); err != nil {
+			return
+		}
+		and = append(and, filter)
+	}
+	if len(and) == 1 {
+		result = and[0]
+	} else {
+		result = and
+	}
+	return
+}
+
+func (self *parser) parseNot() (result QFilter, err error) {
+	if self.accept("NOT") {
+		var filter QFilter
+		if filter, err = self.parseNot(); err != nil {
+			return
+		}
+		result = Not{filter}
+		return
+	}
+	if self.accept("(") {
+		if result, err = self.parseOr(); err != nil {
+			return
+		}
+		err = self.expect(")")
+		return
+	}
+	return self.parseComparison()
+}
+
+// parseField parses the name of a field, and validates that it is indexed in the way wanted.
+func (self *parser) parseField(fulltextWanted bool) (result string, fieldType reflect.Type, err error) {
+	tok := self.pop()
+	if tok.kind != identToken {
+		err = ParseError{tok.position, fmt.Sprintf("Expected a field name, got %v", tok)}
+		return
+	}
+	result = tok.text
+	var found bool
+	if fieldType, found = fieldTypeByPath(self.typ, result); !found {
+		err = ParseError{tok.position, fmt.Sprintf("%v does not have a field named %v", typeName(self.typ), result)}
+		return
+	}
+	if fulltextWanted {
+		if !isFulltext(self.typ, result) {
+			err = ParseError{tok.position, fmt.Sprintf("%v.%v is not tagged fulltext", typeName(self.typ), result)}
+		}
+	} else if !isIndexed(self.typ, result) {
+		err = ParseError{tok.position, fmt.Sprintf("%v.%v is not indexed", typeName(self.typ), result)}
+	}
+	return
+}
+
+// fits returns whether the parsed literal value can be compared to fields of fieldType.
+func fits(value interface{}, fieldType reflect.Type) bool {
+	switch value.(type) {
+	case string:
+		return fieldType.Kind() == reflect.String || (fieldType.Kind() == reflect.Slice && fieldType.Elem().Kind() == reflect.Uint8)
+	case bool:
+		return fieldType.Kind() == reflect.Bool
+	}
+	return isNumeric(fieldType.Kind())
+}
+
+/*
+parseValue parses a literal, converting strings to times if fieldType is time.Time, and validates that it can be
+compared to fields of fieldType.
+*/
+func (self *parser) parseValue(fieldType reflect.Type) (result interface{}, err error) {
+	tok := self.pop()
+	switch tok.kind {
+	case stringToken:
+		if fieldType == timeType {
+			if result, err = time.Parse(time.RFC3339Nano, tok.text); err != nil {
+				err = ParseError{tok.position, fmt.Sprintf("%v is not an RFC3339 time", tok)}
+			}
+			return
+		}
+		result = tok.text
+	case numberToken:
+		if strings.ContainsAny(tok.text, ".eE") {
+			result, err = strconv.ParseFloat(tok.text, 64)
+		} else {
+			result, err = strconv.ParseInt(tok.text, 10, 64)
+		}
+		if err != nil {
+			err = ParseError{tok.position, fmt.Sprintf("%v is not a valid number", tok)}
+		}
+	case identToken:
+		if tok.is("true") {
+			result = true
+		} else if tok.is("false") {
+			result = false
+		} else {
+			err = ParseError{tok.position, fmt.Sprintf("Expected a value, got %v", tok)}
+		}
+	default:
+		err = ParseError{tok.position, fmt.Sprintf("Expected a value, got %v", tok)}
+	}
+	if err == nil && !fits(result, fieldType) {
+		err = ParseError{tok.position, fmt.Sprintf("%v can't be compared to %v fields", tok, fieldType)}
+	}
+	return
+}
+
+// parseValues parses a parenthesized list of values.
+func (self *parser) parseValues(fieldType reflect.Type) (result []interface{}, err error) {
+	if err = self.expect("("); err != nil {
+		return
+	}
+	if self.accept(")") {
+		return
+	}
+	for {
+		var value interface{}
+		if value, err = self.parseValue(fieldType); err != nil {
+			return
+		}
+		result = append(result, value)
+		if self.accept(")") {
+			return
+		}
+		if err = self.expect(","); err != nil {
+			return
+		}
+	}
+}
+
+func (self *parser) parseComparison() (result QFilter, err error) {
+	if self.peek().is("MATCH") {
+		// MATCH Field 'text'
+		self.pop()
+		var field string
+		if field, _, err = self.parseField(true); err != nil {
+			return
+		}
+		tok := self.pop()
+		if tok.kind != stringToken {
+			err = ParseError{tok.position, fmt.Sprintf("Expected a string, got %v", tok)}
+			return
+		}
+		result = Match{field, tok.text}
+		return
+	}
+	var field string
+	var fieldType reflect.Type
+	if field, fieldType, err = self.parseField(false); err != nil {
+		return
+	}
+	elemType := fieldType
+	if multiValued(fieldType) {
+		elemType = fieldType.Elem()
+	}
+	op := self.pop()
+	if op.is("NOT") {
+		// Field NOT IN (values)
+		if err = self.expect("IN"); err != nil {
+			return
+		}
+		var values []interface{}
+		if values, err = self.parseValues(elemType); err != nil {
+			return
+		}
+		result = Not{In{field, values}}
+		return
+	}
+	switch {
+	case op.is("IN"):
+		var values []interface{}
+		if values, err = self.parseValues(elemType); err != nil {
+			return
+		}
+		result = In{field, values}
+		return
+	case op.is("CONTAINS"):
+		if self.accept("ANY") {
+			var values []interface{}
+			if values, err = self.parseValues(elemType); err != nil {
+				return
+			}
+			result = ContainsAny{field, values}
+			return
+		}
+		if self.accept("ALL") {
+			var values []interface{}
+			if values, err = self.parseValues(elemType); err != nil {
+				return
+			}
+			result = ContainsAll{field, values}
+			return
+		}
+		var value interface{}
+		if value, err = self.parseValue(elemType); err != nil {
+			return
+		}
+		result = Contains{field, value}
+		return
+	case op.is("BETWEEN"):
+		var min, max interface{}
+		if min, err = self.parseValue(elemType); err != nil {
+			return
+		}
+		if err = self.expect("AND"); err != nil {
+			return
+		}
+		if max, err = self.parseValue(elemType); err != nil {
+			return
+		}
+		result = Between{field, min, max}
+		return
+	}
+	var value interface{}
+	if value, err = self.parseValue(elemType); err != nil {
+		return
+	}
+	switch {
+	case op.is("="):
+		result = Equals{field, value}
+	case op.is("!="):
+		result = Not{Equals{field, value}}
+	case op.is("<"):
+		result = LessThan{field, value}
+	case op.is("<="):
+		result = LessOrEqual{field, value}
+	case op.is(">"):
+		result = GreaterThan{field, value}
+	case op.is(">="):
+		result = GreaterOrEqual{field, value}
+	case op.is("PREFIX"):
+		result = Prefix{field, value}
+	default:
+		err = ParseError{op.position, fmt.Sprintf("Expected an operator, got %v", op)}
+	}
+	return
+}
+
+func (self *parser) parseInt() (result int, err error) {
+	tok := self.pop()
+	if tok.kind != numberToken {
+		err = ParseError{tok.position, fmt.Sprintf("Expected a number, got %v", tok)}
+		return
+	}
+	if result, err = strconv.Atoi(tok.text); err != nil || result < 0 {
+		err = ParseError{tok.position, fmt.Sprintf("%v is not a valid count", tok)}
+	}
+	return
+}
+
+/*
+ParseQuery will return a Query for objects of the same type as obj, as described by text.
+
+The syntax is a filter, optionally followed by ORDER BY, LIMIT and OFFSET clauses, like
+
+	Name = 'John' AND (Age > 30 OR Tags CONTAINS 'x') ORDER BY CreatedAt DESC LIMIT 10 OFFSET 20
+
+Filters can be combined with AND, OR, NOT and parentheses, and the comparisons are
+
+	Field = value, Field != value, Field < value, Field <= value, Field > value, Field >= value,
+	Field PREFIX value, Field BETWEEN min AND max, Field IN (value, ...), Field NOT IN (value, ...),
+	Field CONTAINS value, Field CONTAINS ANY (value, ...), Field CONTAINS ALL (value, ...) and MATCH Field 'text'.
+
+Values are 'strings' or "strings", numbers, true or false. Strings compared to time.Time fields are parsed as RFC3339.
+
+All fields must be indexed, or tagged fulltext when used in MATCH, and keywords are case insensitive.
+Errors in text are returned as ParseErrors.
+*/
+func (self *DB) ParseQuery(obj interface{}, text string) (result *Query, err error) {
+	var value reflect.Value
+	if value, _, err = identify(obj); err != nil {
+		return
+	}
+	p := &parser{
+		typ: value.Type(),
+	}
+	if p.tokens, err = lex(text); err != nil {
+		return
+	}
+	query := self.Query()
+	query.typ = p.typ
+	if p.peek().kind != endToken && !p.peek().is("ORDER") && !p.peek().is("LIMIT") && !p.peek().is("OFFSET") {
+		var filter QFilter
+		if filter, err = p.parseOr(); err != nil {
+			return
+		}
+		query.Where(filter)
+	}
+	if p.accept("ORDER") {
+		if err = p.expect("BY"); err != nil {
+			return
+		}
+		var field string
+		if field, _, err = p.parseField(false); err != nil {
+			return
+		}
+		if p.accept("DESC") {
+			query.OrderByDesc(field)
+		} else {
+			p.accept("ASC")
+			query.OrderBy(field)
+		}
+	}
+	if p.accept("LIMIT") {
+		var limit int
+		if limit, err = p.parseInt(); err != nil {
+			return
+		}
+		query.Limit(limit)
+	}
+	if p.accept("OFFSET") {
+		var offset int
+		if offset, err = p.parseInt(); err != nil {
+			return
+		}
+		query.Offset(offset)
+	}
+	if tok := p.pop(); tok.kind != endToken {
+		err = ParseError{tok.position, fmt.Sprintf("Unexpected %v", tok)}
+		return
+	}
+	result = query
+	return
+}
@@ -0,0 +1,239 @@
+package kol
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"strings"
+	"time"
+
+	"github.com/zond/kcwraps/kc"
+)
+
+var jsonUnmarshalerType = reflect.TypeOf((*json.Unmarshaler)(nil)).Elem()
+
+/*
+patch loads the stored object with the Id of obj, changes it using apply, and saves it in the same transaction,
+only touching the index entries that changed. The result is loaded into obj and emitted as a single update.
+*/
+func (self *DB) patch(obj interface{}, apply func(stored reflect.Value) error) (err error) {
+	var value, id reflect.Value
+	if value, id, err = identify(obj); err != nil {
+		return
+	}
+	typ := value.Type()
+	idBytes := id.Bytes()
+	oldValue := reflect.New(typ).Elem()
+	newValue := reflect.New(typ).Elem()
+	if err = self.Transact(func(self *DB) (err error) {
+		if err = self.get(idBytes, oldValue, oldValue.Addr().Interface()); err != nil {
+			return
+		}
+		if err = self.get(idBytes, newValue, newValue.Addr().Interface()); err != nil {
+			return
+		}
+		if err = apply(newValue); err != nil {
+			return
+		}
+		if !bytes.Equal(newValue.FieldByName(idField).Bytes(), idBytes) {
+			return fmt.Errorf("Can't change the Id of %v", Id(idBytes))
+		}
+		if version, found := versionOf(newValue); found {
+			oldVersion, _ := versionOf(oldValue)
+			setVersion(version, getVersion(oldVersion)+1)
+		}
+		if updatedAt := newValue.FieldByName(updatedAtField); updatedAt.IsValid() && updatedAt.Type() == timeType {
+			updatedAt.Set(reflect.ValueOf(time.Now()))
+		}
+		if err = self.remember(idBytes, typ, false); err != nil {
+			return
+		}
+		if err = self.reIndex(idBytes, oldValue, newValue, typ); err != nil {
+			return
+		}
+		return self.save(idBytes, typ, newValue.Addr().Interface())
+	}); err != nil {
+		return
+	}
+	value.Set(newValue)
+	return self.db.BetweenTransactions(func(d *kc.DB) (err error) {
+		return self.emit(typ, &oldValue, &value)
+	})
+}
+
+/*
+Update will copy the named fields of obj to the stored object with the Id of obj, and save it, in one transaction.
+Fields of nested structs are named by dotted paths like Address.City.
+
+Obj must be a pointer to a struct having a []byte Id field.
+
+Only the index entries of the changed fields are updated, the UpdatedAt and Version fields are updated like by Set but
+without checking the Version of obj, and subscribers get a single Update. The updated object is loaded into obj.
+
+Returns NotFound if there is no stored object with the Id of obj.
+*/
+func (self *DB) Update(obj interface{}, fields ...string) (err error) {
+	var value reflect.Value
+	if value, _, err = identify(obj); err != nil {
+		return
+	}
+	return self.patch(obj, func(stored reflect.Value) (err error) {
+		for _, field := range fields {
+			var source, destination reflect.Value
+			if source, err = fieldByPath(value, field); err != nil {
+				return
+			}
+			if destination, err = fieldByPath(stored, field); err != nil {
+				return
+			}
+			if !source.IsValid() || !destination.IsValid() {
+				return fmt.Errorf("Can't update %v.%v through a nil pointer", typeName(value.Type()), field)
+			}
+			if !destination.CanSet() {
+				return fmt.Errorf("Can't update the unexported %v.%v", typeName(value.Type()), field)
+			}
+			destination.Set(source)
+		}
+		return
+	})
+}
+
+/*
+Patch will apply patch as a JSON merge patch (RFC 7386) to the stored object with the Id of obj, and save it, in one
+transaction, like Update.
+
+The keys of patch are the JSON names of the fields, nested maps patch nested structs and maps, and nil values reset
+fields to their zero values and remove map entries.
+
+Obj must be a pointer to a struct having a []byte Id field.
+*/
+func (self *DB) Patch(obj interface{}, patch map[string]interface{}) (err error) {
+	var b []byte
+	if b, err = json.Marshal(patch); err != nil {
+		return
+	}
+	return self.PatchJSON(obj, b)
+}
+
+/*
+PatchJSON will apply patch, a JSON merge patch (RFC 7386), to the stored object with the Id of obj, and save it, in one
+transaction, like Update.
+
+Obj must be a pointer to a struct having a []byte Id field.
+*/
+func (self *DB) PatchJSON(obj interface{}, patch []byte) (err error) {
+	return self.patch(obj, func(stored reflect.Value) error {
+		return mergeStruct(stored, patch)
+	})
+}
+
+// jsonField returns the field of the struct value having the JSON name name.
+func jsonField(value reflect.Value, name string) (result reflect.Value, found bool) {
+	typ := value.Type()
+	for i := 0; i < typ.NumField(); i++ {
+		field := typ.Field(i)
+		tag := field.Tag.Get("json")
+		if tag == "-" {
+			continue
+		}
+		jsonName := strings.Split(tag, ",")[0]
+		if jsonName == "" && field.Anonymous {
+			// Embedded structs have their fields promoted
+			if embedded := indirect(value.Field(i)); embedded.IsValid() && embedded.Kind() == reflect.Struct {
+				if result, found = jsonField(embedded, name); found {
+					return
+				}
+			}
+			continue
+		}
+		if field.PkgPath != "" {
+			// Unexported
+			continue
+		}
+		if jsonName == "" {
+			jsonName = field.Name
+		}
+		if strings.EqualFold(jsonName, name) {
+			return value.Field(i), true
+		}
+	}
+	return
+}
+
+// mergeStruct applies the JSON merge patch patch to the struct value.
+func mergeStruct(value reflect.Value, patch []byte) (err error) {
+	var fields map[string]json.RawMessage
+	if err = json.Unmarshal(patch, &fields); err != nil {
+		return
+	}
+	for name, fieldPatch := range fields {
+		field, found := jsonField(value, name)
+		if !found {
+			return fmt.Errorf("%v does not have a field named %v", value.Type(), name)
+		}
+		if err = mergeValue(field, fieldPatch); err != nil {
+			return
+		}
+	}
+	return
+}
+
+// mergeValue applies the JSON merge patch patch to value.
+func mergeValue(value reflect.Value, patch []byte) (err error) {
+	patch = bytes.TrimSpace(patch)
+	if string(patch) == "null" {
+		value.Set(reflect.Zero(value.Type()))
+		return
+	}
+	if len(patch) > 0 && patch[0] == '{' {
+		target := value
+		if target.Kind() == reflect.Ptr {
+			if target.IsNil() {
+				target.Set(reflect.New(target.Type().Elem()))
+			}
+			target = target.Elem()
+		}
+		if !reflect.PtrTo(target.Type()).Implements(jsonUnmarshalerType) {
+			if target.Kind() == reflect.Struct {
+				return mergeStruct(target, patch)
+			}
+			if target.Kind() == reflect.Map && target.Type().Key().Kind() == reflect.String {
+				return mergeMap(target, patch)
+			}
+		}
+	}
+	replacement := reflect.New(value.Type())
+	if err = json.Unmarshal(patch, replacement.Interface()); err != nil {
+		return
+	}
+	value.Set(replacement.Elem())
+	return
+}
+
+// mergeMap applies the JSON merge patch patch to the map value.
+func mergeMap(value reflect.Value, patch []byte) (err error) {
+	var entries map[string]json.RawMessage
+	if err = json.Unmarshal(patch, &entries); err != nil {
+		return
+	}
+	if value.IsNil() {
+		value.Set(reflect.MakeMap(value.Type()))
+	}
+	for key, entryPatch := range entries {
+		keyValue := reflect.ValueOf(key).Convert(value.Type().Key())
+		if string(bytes.TrimSpace(entryPatch)) == "null" {
+			value.SetMapIndex(keyValue, reflect.Value{})
+			continue
+		}
+		entry := reflect.New(value.Type().Elem()).Elem()
+		if existing := value.MapIndex(keyValue); existing.IsValid() {
+			entry.Set(existing)
+		}
+		if err = mergeValue(entry, entryPatch); err != nil {
+			return
+		}
+		value.SetMapIndex(keyValue, entry)
+	}
+	return
+}
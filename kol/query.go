@@ -2,7 +2,7 @@ package kol
 
 import (
 	"bytes"
-	"encoding/json"
+	"encoding/base64"
 	"fmt"
 	"reflect"
 
@@ -12,21 +12,21 @@ import (
 
 // QFilters are used to filter queries
 type QFilter interface {
-	source(typ reflect.Type) (result setop.SetOpSource, err error)
+	source(db *DB, typ reflect.Type) (result setop.SetOpSource, err error)
 	match(db *DB, typ reflect.Type, value reflect.Value) (result bool, err error)
 }
 
 // Or is a QFilter that defineds an OR operation.
 type Or []QFilter
 
-func (self Or) source(typ reflect.Type) (result setop.SetOpSource, err error) {
+func (self Or) source(db *DB, typ reflect.Type) (result setop.SetOpSource, err error) {
 	op := setop.SetOp{
 		Merge: setop.First,
 		Type:  setop.Union,
 	}
 	for _, filter := range self {
 		var newSource setop.SetOpSource
-		if newSource, err = filter.source(typ); err != nil {
+		if newSource, err = filter.source(db, typ); err != nil {
 			return
 		}
 		op.Sources = append(op.Sources, newSource)
@@ -47,14 +47,28 @@ func (self Or) match(db *DB, typ reflect.Type, value reflect.Value) (result bool
 // And is a QFilter that defines an AND operation.
 type And []QFilter
 
-func (self And) source(typ reflect.Type) (result setop.SetOpSource, err error) {
+func (self And) source(db *DB, typ reflect.Type) (result setop.SetOpSource, err error) {
 	op := setop.SetOp{
 		Merge: setop.First,
 		Type:  setop.Intersection,
 	}
-	for _, filter := range self {
+	filters := self
+	// Use a composite index for as many of the filters as possible
+	planned, rest, found, err := self.compositeSource(db, typ)
+	if err != nil {
+		return
+	}
+	if found {
+		if len(rest) == 0 {
+			result = planned
+			return
+		}
+		op.Sources = append(op.Sources, planned)
+		filters = rest
+	}
+	for _, filter := range filters {
 		var newSource setop.SetOpSource
-		if newSource, err = filter.source(typ); err != nil {
+		if newSource, err = filter.source(db, typ); err != nil {
 			return
 		}
 		op.Sources = append(op.Sources, newSource)
@@ -83,7 +97,7 @@ type Join struct {
 	IdField    string
 }
 
-func (self Join) source(typ reflect.Type) (result setop.SetOpSource, err error) {
+func (self Join) source(db *DB, typ reflect.Type) (result setop.SetOpSource, err error) {
 	var value reflect.Value
 	if value, _, err = identify(self.Match); err != nil {
 		return
@@ -98,7 +112,7 @@ func (self Join) source(typ reflect.Type) (result setop.SetOpSource, err error)
 		return
 	}
 	result = setop.SetOpSource{
-		Key: kc.JoinKeys([][]byte{[]byte(foreignIndex), []byte(value.Type().Name()), []byte(self.MatchField), []byte(self.IdField), b}),
+		Key: kc.JoinKeys([][]byte{[]byte(foreignIndex), []byte(typeName(value.Type())), []byte(self.MatchField), []byte(self.IdField), b}),
 	}
 	return
 }
@@ -136,33 +150,94 @@ type Equals struct {
 	Value interface{}
 }
 
-func (self Equals) source(typ reflect.Type) (result setop.SetOpSource, err error) {
-	value := reflect.ValueOf(self.Value)
+func (self Equals) source(db *DB, typ reflect.Type) (result setop.SetOpSource, err error) {
+	if !isIndexed(typ, self.Field) {
+		err = unindexedError(typ, self.Field)
+		return
+	}
 	var b []byte
-	if b, err = indexBytes(value.Type(), value); err != nil {
+	if b, err = filterBytes(typ, self.Field, self.Value); err != nil {
 		return
 	}
 	result = setop.SetOpSource{
-		Key: kc.JoinKeys([][]byte{[]byte(secondaryIndex), []byte(typ.Name()), []byte(self.Field), b}),
+		Key: kc.JoinKeys([][]byte{[]byte(secondaryIndex), []byte(typeName(typ)), []byte(self.Field), b}),
 	}
 	return
 }
 
 func (self Equals) match(db *DB, typ reflect.Type, value reflect.Value) (result bool, err error) {
-	selfValue := reflect.ValueOf(self.Value)
-	bothType := selfValue.Type()
 	var selfBytes []byte
-	if selfBytes, err = indexBytes(bothType, selfValue); err != nil {
+	if selfBytes, err = filterBytes(typ, self.Field, self.Value); err != nil {
+		return
+	}
+	var field reflect.Value
+	if field, err = fieldByPath(value, self.Field); err != nil || !field.IsValid() {
 		return
 	}
-	var otherBytes []byte
-	if otherBytes, err = indexBytes(bothType, value.FieldByName(self.Field)); err != nil {
+	var otherBytes [][]byte
+	if otherBytes, err = valueBytes(field.Type(), field); err != nil {
 		return
 	}
-	result = bytes.Compare(selfBytes, otherBytes) == 0
+	for _, b := range otherBytes {
+		if bytes.Compare(selfBytes, b) == 0 {
+			result = true
+			return
+		}
+	}
 	return
 }
 
+// Not is a QFilter that matches everything Filter doesn't match.
+type Not struct {
+	Filter QFilter
+}
+
+func (self Not) source(db *DB, typ reflect.Type) (result setop.SetOpSource, err error) {
+	var source setop.SetOpSource
+	if source, err = self.Filter.source(db, typ); err != nil {
+		return
+	}
+	result.SetOp = &setop.SetOp{
+		Sources: []setop.SetOpSource{allSource(typ), source},
+		Type:    setop.Difference,
+		Merge:   setop.First,
+	}
+	return
+}
+
+func (self Not) match(db *DB, typ reflect.Type, value reflect.Value) (result bool, err error) {
+	if result, err = self.Filter.match(db, typ, value); err != nil {
+		return
+	}
+	result = !result
+	return
+}
+
+// In is a QFilter that matches if Field equals any of Values.
+type In struct {
+	Field  string
+	Values []interface{}
+}
+
+func (self In) filter() (result Or) {
+	for _, value := range self.Values {
+		result = append(result, Equals{self.Field, value})
+	}
+	return
+}
+
+func (self In) source(db *DB, typ reflect.Type) (result setop.SetOpSource, err error) {
+	if len(self.Values) == 0 {
+		result = emptySource(typ)
+		return
+	}
+	return self.filter().source(db, typ)
+}
+
+func (self In) match(db *DB, typ reflect.Type, value reflect.Value) (result bool, err error) {
+	return self.filter().match(db, typ, value)
+}
+
 /*
 Query is a search operation using an SQL-like syntax to fetch records from the database.
 
@@ -174,6 +249,16 @@ type Query struct {
 	intersection QFilter
 	difference   QFilter
 	limit        int
+	orderBy      string
+	descending   bool
+	offset       int
+	after        string
+	position     [][]byte
+	found        int
+	rankBy       *Match
+	scan         bool
+	filtered     bool
+	withDeleted  bool
 }
 
 /*
@@ -203,7 +288,10 @@ func (self *Query) Subscription(name string, obj interface{}, ops Operation, sub
 }
 
 func (self *Query) match(typ reflect.Type, value reflect.Value) (result bool, err error) {
-	if self.typ.Name() != typ.Name() {
+	if typeName(self.typ) != typeName(typ) {
+		return
+	}
+	if _, deleted := deletedAt(value); deleted && !self.withDeleted {
 		return
 	}
 	if self.intersection != nil {
@@ -213,7 +301,7 @@ func (self *Query) match(typ reflect.Type, value reflect.Value) (result bool, er
 	}
 	if self.difference != nil {
 		if result, err = self.difference.match(self.db, typ, value); err != nil || result {
-			result = true
+			result = false
 			return
 		}
 	}
@@ -221,27 +309,45 @@ func (self *Query) match(typ reflect.Type, value reflect.Value) (result bool, er
 	return
 }
 
-func (self *Query) each(f func(elementPointer reflect.Value) bool) error {
-	op := &setop.SetOp{
+/*
+setOp returns the set operation finding the matches of this query.
+
+If the query is allowed to Scan and has filters on fields without indices, filtered is set and the set operation
+finds a superset of the matches that each record must be matched against.
+*/
+func (self *Query) setOp() (op *setop.SetOp, err error) {
+	intersection, difference := self.intersection, self.difference
+	self.filtered = false
+	if self.scan {
+		if intersection != nil && !indexed(self.typ, intersection) {
+			intersection = superset(self.typ, intersection)
+			self.filtered = true
+		}
+		if difference != nil && !indexed(self.typ, difference) {
+			difference = nil
+			self.filtered = true
+		}
+	}
+	op = &setop.SetOp{
 		Sources: []setop.SetOpSource{
 			setop.SetOpSource{
-				Key: kc.JoinKeys([][]byte{[]byte(primaryKey), []byte(self.typ.Name())}),
+				Key: kc.JoinKeys([][]byte{[]byte(primaryKey), []byte(typeName(self.typ))}),
 			},
 		},
 		Type:  setop.Intersection,
 		Merge: setop.First,
 	}
-	if self.intersection != nil {
-		source, err := self.intersection.source(self.typ)
-		if err != nil {
-			return err
+	if intersection != nil {
+		var source setop.SetOpSource
+		if source, err = intersection.source(self.db, self.typ); err != nil {
+			return
 		}
 		op.Sources = append(op.Sources, source)
 	}
-	if self.difference != nil {
-		source, err := self.difference.source(self.typ)
-		if err != nil {
-			return err
+	if difference != nil {
+		var source setop.SetOpSource
+		if source, err = difference.source(self.db, self.typ); err != nil {
+			return
 		}
 		op = &setop.SetOp{
 			Sources: []setop.SetOpSource{
@@ -254,28 +360,514 @@ func (self *Query) each(f func(elementPointer reflect.Value) bool) error {
 			Merge: setop.First,
 		}
 	}
-	limit := self.limit
-	for _, kv := range self.db.db.SetOp(&setop.SetExpression{
+	if self.excludesDeleted() {
+		op = self.withoutDeleted(op)
+	}
+	return
+}
+
+/*
+visitor decodes the records found by a query, and keeps track of offset, limit and the position
+of the last visited record.
+*/
+type visitor struct {
+	query  *Query
+	f      func(elementPointer reflect.Value) bool
+	skip   int
+	limit  int
+	before [][]byte
+}
+
+// visit returns whether the query is done.
+func (self *visitor) visit(position [][]byte, b []byte) (done bool) {
+	obj := reflect.New(self.query.typ).Interface()
+	if err := self.query.db.decode(b, obj); err != nil {
+		return
+	}
+	if self.query.filtered {
+		if matched, err := self.query.match(self.query.typ, reflect.ValueOf(obj).Elem()); err != nil || !matched {
+			return
+		}
+	}
+	if self.skip > 0 {
+		self.skip--
+		return
+	}
+	self.query.position = position
+	self.query.found++
+	if self.f(reflect.ValueOf(obj)) {
+		return true
+	}
+	if self.limit == 1 {
+		return true
+	} else if self.limit > 1 {
+		self.limit--
+	}
+	return
+}
+
+func (self *Query) each(f func(elementPointer reflect.Value) bool) error {
+	op, err := self.setOp()
+	if err != nil {
+		return err
+	}
+	v := &visitor{
+		query: self,
+		f:     f,
+		skip:  self.offset,
+		limit: self.limit,
+	}
+	self.position, self.found = nil, 0
+	if v.before, err = self.decodeToken(); err != nil {
+		return err
+	}
+	if self.rankBy != nil {
+		return self.eachRanked(op, v)
+	}
+	if self.orderBy != "" {
+		return self.eachOrdered(op, v)
+	}
+	expr := &setop.SetExpression{
 		Op: op,
-	}) {
-		obj := reflect.New(self.typ).Interface()
-		if err := json.Unmarshal(kv.Value, obj); err == nil {
-			if f(reflect.ValueOf(obj)) {
-				break
+	}
+	if v.before != nil {
+		// Seek to the record after the token
+		expr.Min = v.before[0]
+	}
+	if !self.filtered && self.limit > 0 {
+		// Only load the records that will be visited
+		expr.Len = self.offset + self.limit
+	}
+	for _, kv := range self.db.db.SetOp(expr) {
+		if v.visit(kv.Keys, kv.Value) {
+			break
+		}
+	}
+	return nil
+}
+
+/*
+eachOrdered walks the secondary index of the orderBy field, and visits all objects
+also matching op.
+
+Objects whose orderBy field is inside a nil struct pointer are visited last, or first if descending.
+*/
+func (self *Query) eachOrdered(op *setop.SetOp, v *visitor) (err error) {
+	if !isIndexed(self.typ, self.orderBy) {
+		return fmt.Errorf("%v.%v is not indexed, and can not be used to order queries", typeName(self.typ), self.orderBy)
+	}
+	if fieldType, _ := fieldTypeByPath(self.typ, self.orderBy); multiValued(fieldType) {
+		return fmt.Errorf("%v.%v has multiple values, and can not be used to order queries", typeName(self.typ), self.orderBy)
+	}
+	var matching map[string]bool
+	if self.intersection != nil || self.difference != nil || self.excludesDeleted() {
+		matching = make(map[string]bool)
+		for _, kv := range self.db.db.SetOp(&setop.SetExpression{
+			Op: op,
+		}) {
+			matching[string(kv.Keys[0])] = true
+		}
+	}
+	nillable := nillablePath(self.typ, self.orderBy)
+	missing := len(v.before) == len(missingPosition(nil))
+	done := false
+	if self.descending && nillable && (v.before == nil || missing) {
+		// Records without values come first in descending order
+		if done, err = self.eachMissing(op, v, missing); err != nil || done {
+			return
+		}
+	}
+	if !missing || self.descending {
+		before := v.before
+		if missing {
+			before = nil
+		}
+		if done, err = self.eachIndexed(matching, v, before); err != nil || done {
+			return
+		}
+	}
+	if !self.descending && nillable {
+		_, err = self.eachMissing(op, v, missing)
+	}
+	return
+}
+
+// missingPosition returns the position of the record with id when it has no value for the field ordering a query.
+func missingPosition(id []byte) [][]byte {
+	return [][]byte{[]byte{}, id, []byte{}}
+}
+
+/*
+eachMissing visits the objects matching op without values for the orderBy field, because it is inside a nil struct
+pointer, in order of Id. If resume is set, it starts after the position in v.before.
+*/
+func (self *Query) eachMissing(op *setop.SetOp, v *visitor, resume bool) (done bool, err error) {
+	kvs := self.db.db.SetOp(&setop.SetExpression{
+		Op: &setop.SetOp{
+			Sources: []setop.SetOpSource{
+				setop.SetOpSource{
+					SetOp: op,
+				},
+				setop.SetOpSource{
+					Key: kc.JoinKeys(kc.Keyify(nilIndex, typeName(self.typ), self.orderBy)),
+				},
+			},
+			Type:  setop.Intersection,
+			Merge: setop.First,
+		},
+	})
+	for i := range kvs {
+		kv := kvs[i]
+		if self.descending {
+			kv = kvs[len(kvs)-1-i]
+		}
+		if resume {
+			if comparison := bytes.Compare(kv.Keys[0], v.before[1]); comparison == 0 || (comparison < 0) != self.descending {
+				continue
 			}
 		}
-		if limit == 1 {
+		if v.visit(missingPosition(kv.Keys[0]), kv.Value) {
+			return true, nil
+		}
+	}
+	return
+}
+
+/*
+eachIndexed visits the objects with Ids in matching, or all objects if matching is nil, having values for the orderBy
+field in its secondary index, in order of the value. If before is set, it starts after that position.
+*/
+func (self *Query) eachIndexed(matching map[string]bool, v *visitor, before [][]byte) (done bool, err error) {
+	keys := kc.Keyify(secondaryIndex, typeName(self.typ), self.orderBy)
+	prefix := kc.JoinKeys(keys)
+	var after []byte
+	if before != nil {
+		after = kc.JoinKeys(append(keys, before...))
+	}
+	cursor := self.db.db.Cursor()
+	if self.descending {
+		if after == nil {
+			// The last key with this prefix is before the prefix with its terminating {0, 1} replaced by {0, 2}
+			end := kc.JoinKeys(keys)
+			end[len(end)-1] = 2
+			err = cursor.KCCUR.JumpBackKey(end)
+		} else {
+			err = cursor.KCCUR.JumpBackKey(after)
+		}
+	} else {
+		if after == nil {
+			err = cursor.KCCUR.JumpKey(prefix)
+		} else {
+			err = cursor.KCCUR.JumpKey(after)
+		}
+	}
+	for err == nil {
+		var key []byte
+		if key, err = cursor.KCCUR.GetKey(false); err != nil {
 			break
-		} else if limit > 1 {
-			limit--
+		}
+		if !bytes.HasPrefix(key, prefix) {
+			break
+		}
+		if after == nil || bytes.Compare(key, after) != 0 {
+			position := kc.SplitKeys(key)[len(keys):]
+			id := position[1]
+			if matching == nil || matching[string(id)] {
+				b, getErr := self.db.db.Get(kc.Keyify(primaryKey, typeName(self.typ), id))
+				if getErr == nil {
+					if v.visit(position, b) {
+						done = true
+						break
+					}
+				} else if getErr.Error() != kc.NoRecord {
+					err = getErr
+					break
+				}
+			}
+		}
+		if self.descending {
+			err = cursor.KCCUR.StepBack()
+		} else {
+			err = cursor.KCCUR.Step()
 		}
 	}
-	return nil
+	if err != nil && err.Error() == kc.NoRecord {
+		err = nil
+	}
+	return
+}
+
+/*
+eachRanked visits all objects matching op, ordered by their relevance for rankBy.
+*/
+func (self *Query) eachRanked(op *setop.SetOp, v *visitor) (err error) {
+	if self.orderBy != "" {
+		return fmt.Errorf("Can't both order by %v and rank by %v", self.orderBy, self.rankBy.Field)
+	}
+	var results []ranked
+	if results, err = self.rank(self.db.db.SetOp(&setop.SetExpression{
+		Op: op,
+	})); err != nil {
+		return
+	}
+	var after []byte
+	if v.before != nil {
+		after = kc.JoinKeys(v.before)
+	}
+	for _, result := range results {
+		if after != nil && bytes.Compare(kc.JoinKeys(result.position), after) <= 0 {
+			continue
+		}
+		if v.visit(result.position, result.value) {
+			break
+		}
+	}
+	return
+}
+
+func (self *Query) tokenHeader() [][]byte {
+	if self.rankBy != nil {
+		return [][]byte{[]byte(self.rankBy.Field), []byte{2}}
+	}
+	direction := []byte{0}
+	if self.descending {
+		direction = []byte{1}
+	}
+	return [][]byte{[]byte(self.orderBy), direction}
+}
+
+func (self *Query) encodeToken(position [][]byte) string {
+	return base64.URLEncoding.EncodeToString(kc.JoinKeys(append(self.tokenHeader(), position...)))
+}
+
+func (self *Query) decodeToken() (position [][]byte, err error) {
+	if self.after == "" {
+		return
+	}
+	var b []byte
+	if b, err = base64.URLEncoding.DecodeString(self.after); err != nil {
+		return
+	}
+	var keys [][]byte
+	if keys, err = kc.ParseKeys(b); err != nil {
+		err = fmt.Errorf("%#v is not a valid token for this query", self.after)
+		return
+	}
+	header := self.tokenHeader()
+	wantedLength := len(header) + 1
+	if self.orderBy != "" || self.rankBy != nil {
+		wantedLength++
+	}
+	if self.orderBy != "" && len(keys) == len(header)+len(missingPosition(nil)) {
+		// The position of a record without value for the orderBy field
+		wantedLength = len(keys)
+	}
+	if len(keys) != wantedLength || bytes.Compare(keys[0], header[0]) != 0 || bytes.Compare(keys[1], header[1]) != 0 {
+		err = fmt.Errorf("%#v is not a valid token for this query", self.after)
+		return
+	}
+	position = keys[len(header):]
+	return
+}
+
+/*
+indexOnlyKeys returns the keys of a collection containing exactly the matches of this query,
+if there is one, i.e. the primary key of the type if there are no filters, or the secondary index
+value if the only filter is an Equals on an indexed field.
+*/
+func (self *Query) indexOnlyKeys() (keys [][]byte, err error) {
+	if self.difference != nil || self.excludesDeleted() {
+		return
+	}
+	if self.intersection == nil {
+		keys = kc.Keyify(primaryKey, typeName(self.typ))
+		return
+	}
+	if equals, ok := self.intersection.(Equals); ok && isIndexed(self.typ, equals.Field) {
+		var b []byte
+		if b, err = filterBytes(self.typ, equals.Field, equals.Value); err != nil {
+			return
+		}
+		keys = [][]byte{[]byte(secondaryIndex), []byte(typeName(self.typ)), []byte(equals.Field), b}
+	}
+	return
+}
+
+/*
+Count will return the number of matches of this query among objects of the same type as obj, without
+loading them.
+
+Obj must be a pointer to a struct having a []byte Id field. Offset, Limit and After are ignored.
+*/
+func (self *Query) Count(obj interface{}) (result int, err error) {
+	var value reflect.Value
+	if value, _, err = identify(obj); err != nil {
+		return
+	}
+	self.typ = value.Type()
+	var keys [][]byte
+	if keys, err = self.indexOnlyKeys(); err != nil {
+		return
+	}
+	if keys != nil {
+		result = self.db.db.CountCollection(keys)
+		return
+	}
+	var op *setop.SetOp
+	if op, err = self.setOp(); err != nil {
+		return
+	}
+	if self.filtered {
+		for _, kv := range self.db.db.SetOp(&setop.SetExpression{
+			Op: op,
+		}) {
+			obj := reflect.New(self.typ).Interface()
+			if err = self.db.decode(kv.Value, obj); err != nil {
+				return
+			}
+			var matched bool
+			if matched, err = self.match(self.typ, reflect.ValueOf(obj).Elem()); err != nil {
+				return
+			}
+			if matched {
+				result++
+			}
+		}
+		return
+	}
+	result = self.db.db.SetOpCount(&setop.SetExpression{
+		Op: op,
+	})
+	return
+}
+
+// existsBatch is the number of candidates Exists loads at a time when it has to scan them.
+const existsBatch = 64
+
+/*
+Exists will return whether there are any matches of this query among objects of the same type as obj, without
+loading them, except the candidates up to the first match if the query has to Scan.
+
+Obj must be a pointer to a struct having a []byte Id field.
+*/
+func (self *Query) Exists(obj interface{}) (result bool, err error) {
+	var value reflect.Value
+	if value, _, err = identify(obj); err != nil {
+		return
+	}
+	self.typ = value.Type()
+	var keys [][]byte
+	if keys, err = self.indexOnlyKeys(); err != nil {
+		return
+	}
+	if keys != nil {
+		result = self.db.db.HasCollection(keys)
+		return
+	}
+	var op *setop.SetOp
+	if op, err = self.setOp(); err != nil {
+		return
+	}
+	if !self.filtered {
+		result = self.db.db.SetOpCount(&setop.SetExpression{
+			Op:  op,
+			Len: 1,
+		}) > 0
+		return
+	}
+	// Load the candidates in batches, until one of them matches
+	var after []byte
+	for {
+		batch := self.db.db.SetOp(&setop.SetExpression{
+			Op:  op,
+			Min: after,
+			Len: existsBatch,
+		})
+		for _, kv := range batch {
+			obj := reflect.New(self.typ).Interface()
+			if err = self.db.decode(kv.Value, obj); err != nil {
+				return
+			}
+			if result, err = self.match(self.typ, reflect.ValueOf(obj).Elem()); err != nil || result {
+				return
+			}
+			after = kv.Keys[0]
+		}
+		if len(batch) < existsBatch {
+			return
+		}
+	}
+}
+
+// Offset will skip the first n matches.
+func (self *Query) Offset(n int) *Query {
+	self.offset = n
+	return self
+}
+
+/*
+After will make the query start after the position encoded in token, as returned by Page.
+
+Since the token encodes the position in the primary key or the ordering index, it will remain
+valid even if objects are added or removed.
+*/
+func (self *Query) After(token string) *Query {
+	self.after = token
+	return self
+}
+
+/*
+Page will load the results of this query into result, like All, and return a token that can be
+given to After to continue after the last result.
+
+The token will be empty if fewer results than the Limit of the query were found.
+*/
+func (self *Query) Page(result interface{}) (next string, err error) {
+	if err = self.All(result); err != nil {
+		return
+	}
+	if self.limit > 0 && self.found >= self.limit && self.position != nil {
+		next = self.encodeToken(self.position)
+	}
+	return
+}
+
+// OrderBy will return the matches in ascending order of the indexed field, with matches where it is inside a nil struct pointer last.
+func (self *Query) OrderBy(field string) *Query {
+	self.orderBy = field
+	self.descending = false
+	return self
+}
+
+/*
+RankBy will return the matches in descending order of relevance for match, i.e. of how many times the terms of
+match.Text occur in match.Field, which must be tagged kol:"fulltext".
+
+RankBy does not filter the matches, so it is usually combined with match as a filter.
+*/
+func (self *Query) RankBy(match Match) *Query {
+	self.rankBy = &match
+	return self
+}
+
+// OrderByDesc will return the matches in descending order of the indexed field, with matches where it is inside a nil struct pointer first.
+func (self *Query) OrderByDesc(field string) *Query {
+	self.orderBy = field
+	self.descending = true
+	return self
 }
 
 // Except will add a filter excluding matching items from the results of this query.
+// Items matching any of the filters added by repeated calls are excluded.
 func (self *Query) Except(f QFilter) *Query {
-	self.difference = f
+	switch difference := self.difference.(type) {
+	case nil:
+		self.difference = f
+	case Or:
+		self.difference = append(append(Or{}, difference...), f)
+	default:
+		self.difference = Or{difference, f}
+	}
 	return self
 }
 
@@ -286,8 +878,16 @@ func (self *Query) Limit(l int) *Query {
 }
 
 // Where will add a filter limiting the results of this query to matching items.
+// Only items matching all of the filters added by repeated calls are included.
 func (self *Query) Where(f QFilter) *Query {
-	self.intersection = f
+	switch intersection := self.intersection.(type) {
+	case nil:
+		self.intersection = f
+	case And:
+		self.intersection = append(append(And{}, intersection...), f)
+	default:
+		self.intersection = And{intersection, f}
+	}
 	return self
 }
 
@@ -0,0 +1,306 @@
+package kol
+
+import (
+	"bytes"
+	"fmt"
+	"reflect"
+
+	"github.com/zond/kcwraps/kc"
+	"github.com/zond/setop"
+)
+
+// GreaterThan is a QFilter that defines a > operation.
+type GreaterThan struct {
+	Field string
+	Value interface{}
+}
+
+func (self GreaterThan) indexRange() indexRange {
+	return indexRange{field: self.Field, min: self.Value}
+}
+
+func (self GreaterThan) source(db *DB, typ reflect.Type) (result setop.SetOpSource, err error) {
+	return self.indexRange().source(db, typ)
+}
+
+func (self GreaterThan) match(db *DB, typ reflect.Type, value reflect.Value) (result bool, err error) {
+	return self.indexRange().match(db, typ, value)
+}
+
+// GreaterOrEqual is a QFilter that defines a >= operation.
+type GreaterOrEqual struct {
+	Field string
+	Value interface{}
+}
+
+func (self GreaterOrEqual) indexRange() indexRange {
+	return indexRange{field: self.Field, min: self.Value, minInclusive: true}
+}
+
+func (self GreaterOrEqual) source(db *DB, typ reflect.Type) (result setop.SetOpSource, err error) {
+	return self.indexRange().source(db, typ)
+}
+
+func (self GreaterOrEqual) match(db *DB, typ reflect.Type, value reflect.Value) (result bool, err error) {
+	return self.indexRange().match(db, typ, value)
+}
+
+// LessThan is a QFilter that defines a < operation.
+type LessThan struct {
+	Field string
+	Value interface{}
+}
+
+func (self LessThan) indexRange() indexRange {
+	return indexRange{field: self.Field, max: self.Value}
+}
+
+func (self LessThan) source(db *DB, typ reflect.Type) (result setop.SetOpSource, err error) {
+	return self.indexRange().source(db, typ)
+}
+
+func (self LessThan) match(db *DB, typ reflect.Type, value reflect.Value) (result bool, err error) {
+	return self.indexRange().match(db, typ, value)
+}
+
+// LessOrEqual is a QFilter that defines a <= operation.
+type LessOrEqual struct {
+	Field string
+	Value interface{}
+}
+
+func (self LessOrEqual) indexRange() indexRange {
+	return indexRange{field: self.Field, max: self.Value, maxInclusive: true}
+}
+
+func (self LessOrEqual) source(db *DB, typ reflect.Type) (result setop.SetOpSource, err error) {
+	return self.indexRange().source(db, typ)
+}
+
+func (self LessOrEqual) match(db *DB, typ reflect.Type, value reflect.Value) (result bool, err error) {
+	return self.indexRange().match(db, typ, value)
+}
+
+// Between is a QFilter that matches values between Min and Max, inclusive.
+type Between struct {
+	Field string
+	Min   interface{}
+	Max   interface{}
+}
+
+func (self Between) indexRange() indexRange {
+	return indexRange{field: self.Field, min: self.Min, minInclusive: true, max: self.Max, maxInclusive: true}
+}
+
+func (self Between) source(db *DB, typ reflect.Type) (result setop.SetOpSource, err error) {
+	return self.indexRange().source(db, typ)
+}
+
+func (self Between) match(db *DB, typ reflect.Type, value reflect.Value) (result bool, err error) {
+	return self.indexRange().match(db, typ, value)
+}
+
+// Prefix is a QFilter that matches string or []byte values beginning with Value.
+type Prefix struct {
+	Field string
+	Value interface{}
+}
+
+func (self Prefix) indexRange() indexRange {
+	return indexRange{field: self.Field, min: self.Value, minInclusive: true, prefix: true}
+}
+
+func (self Prefix) source(db *DB, typ reflect.Type) (result setop.SetOpSource, err error) {
+	return self.indexRange().source(db, typ)
+}
+
+func (self Prefix) match(db *DB, typ reflect.Type, value reflect.Value) (result bool, err error) {
+	return self.indexRange().match(db, typ, value)
+}
+
+/*
+indexRange is a range of values in the secondary index of a field.
+
+A nil min or max means that the range is unbounded in that direction, and prefix means
+that the range contains all values beginning with min.
+*/
+type indexRange struct {
+	field        string
+	min          interface{}
+	max          interface{}
+	minInclusive bool
+	maxInclusive bool
+	prefix       bool
+}
+
+func (self indexRange) bounds(typ reflect.Type) (min, max []byte, err error) {
+	if self.min != nil {
+		if min, err = filterBytes(typ, self.field, self.min); err != nil {
+			return
+		}
+	}
+	if self.max != nil {
+		if max, err = filterBytes(typ, self.field, self.max); err != nil {
+			return
+		}
+	}
+	return
+}
+
+// accept returns whether b is inside the range, and whether all values after b are outside it.
+func (self indexRange) accept(min, max, b []byte) (ok, done bool) {
+	if self.prefix {
+		ok = bytes.HasPrefix(b, min)
+		done = !ok && bytes.Compare(b, min) > 0
+		return
+	}
+	if min != nil {
+		if cmp := bytes.Compare(b, min); cmp < 0 || (cmp == 0 && !self.minInclusive) {
+			return
+		}
+	}
+	if max != nil {
+		if cmp := bytes.Compare(b, max); cmp > 0 || (cmp == 0 && !self.maxInclusive) {
+			done = true
+			return
+		}
+	}
+	ok = true
+	return
+}
+
+func (self indexRange) source(db *DB, typ reflect.Type) (result setop.SetOpSource, err error) {
+	if !isIndexed(typ, self.field) {
+		err = unindexedError(typ, self.field)
+		return
+	}
+	var min, max []byte
+	if min, max, err = self.bounds(typ); err != nil {
+		return
+	}
+	var values [][]byte
+	if values, err = db.indexValues(typ, self.field, min, func(b []byte) (ok, done bool) {
+		return self.accept(min, max, b)
+	}); err != nil {
+		return
+	}
+	if len(values) == 0 {
+		result = emptySource(typ)
+		return
+	}
+	op := setop.SetOp{
+		Merge: setop.First,
+		Type:  setop.Union,
+	}
+	for _, value := range values {
+		op.Sources = append(op.Sources, setop.SetOpSource{
+			Key: kc.JoinKeys([][]byte{[]byte(secondaryIndex), []byte(typeName(typ)), []byte(self.field), value}),
+		})
+	}
+	result.SetOp = &op
+	return
+}
+
+func (self indexRange) match(db *DB, typ reflect.Type, value reflect.Value) (result bool, err error) {
+	var min, max []byte
+	if min, max, err = self.bounds(typ); err != nil {
+		return
+	}
+	var field reflect.Value
+	if field, err = fieldByPath(value, self.field); err != nil || !field.IsValid() {
+		return
+	}
+	var values [][]byte
+	if values, err = valueBytes(field.Type(), field); err != nil {
+		return
+	}
+	for _, b := range values {
+		if result, _ = self.accept(min, max, b); result {
+			return
+		}
+	}
+	return
+}
+
+// allSource returns a source containing all records of typ.
+func allSource(typ reflect.Type) setop.SetOpSource {
+	return setop.SetOpSource{
+		Key: kc.JoinKeys([][]byte{[]byte(primaryKey), []byte(typeName(typ))}),
+	}
+}
+
+// emptySource returns a source without any members.
+func emptySource(typ reflect.Type) setop.SetOpSource {
+	pk := allSource(typ)
+	return setop.SetOpSource{
+		SetOp: &setop.SetOp{
+			Sources: []setop.SetOpSource{pk, pk},
+			Type:    setop.Difference,
+			Merge:   setop.First,
+		},
+	}
+}
+
+/*
+indexValues returns the distinct values in the secondary index of fieldName in typ, starting at start,
+for which accept returns ok, until accept returns done.
+*/
+func (self *DB) indexValues(typ reflect.Type, fieldName string, start []byte, accept func(b []byte) (ok, done bool)) (result [][]byte, err error) {
+	var tuples [][][]byte
+	if tuples, err = self.distinctValues(kc.Keyify(secondaryIndex, typeName(typ), fieldName), 1, start, accept); err != nil {
+		return
+	}
+	for _, tuple := range tuples {
+		result = append(result, tuple[0])
+	}
+	return
+}
+
+/*
+distinctValues returns the distinct tuples of the depth levels following keys, starting at a first level of start,
+for which accept returns ok for the first level, until accept returns done.
+*/
+func (self *DB) distinctValues(keys [][]byte, depth int, start []byte, accept func(b []byte) (ok, done bool)) (result [][][]byte, err error) {
+	prefix := kc.JoinKeys(keys)
+	jump := prefix
+	if start != nil {
+		// Start at the escaped start value without its terminating {0, 1}, to include all values beginning with it
+		jump = kc.JoinKeys(append(keys, start))
+		jump = jump[:len(jump)-2]
+	}
+	cursor := self.db.Cursor()
+	for {
+		if err = cursor.KCCUR.JumpKey(jump); err != nil {
+			break
+		}
+		var key []byte
+		if key, err = cursor.KCCUR.GetKey(false); err != nil {
+			break
+		}
+		if !bytes.HasPrefix(key, prefix) {
+			break
+		}
+		split := kc.SplitKeys(key)
+		if len(split) < len(keys)+depth {
+			err = fmt.Errorf("%v is not %v levels deeper than %v", split, depth, keys)
+			break
+		}
+		tuple := split[len(keys) : len(keys)+depth]
+		ok, done := accept(tuple[0])
+		if done {
+			break
+		}
+		if ok {
+			result = append(result, tuple)
+		} else {
+			tuple = tuple[:1]
+		}
+		// Jump past all ids of this tuple by replacing the terminating {0, 1} of the last escaped value with {0, 2}
+		jump = kc.JoinKeys(append(append([][]byte{}, keys...), tuple...))
+		jump[len(jump)-1] = 2
+	}
+	if err != nil && err.Error() == kc.NoRecord {
+		err = nil
+	}
+	return
+}
@@ -0,0 +1,90 @@
+package kol
+
+import (
+	"fmt"
+	"reflect"
+)
+
+// unindexedError returns the error for filtering on fieldName in typ when it has no index.
+func unindexedError(typ reflect.Type, fieldName string) error {
+	return fmt.Errorf("%v.%v is not indexed, use Query.Scan to allow filtering on it by scanning all records", typeName(typ), fieldName)
+}
+
+// indexed returns whether all fields used by filter have the indices it needs, so that it doesn't need Query.Scan.
+func indexed(typ reflect.Type, filter QFilter) bool {
+	switch f := filter.(type) {
+	case Equals:
+		return isIndexed(typ, f.Field)
+	case Contains:
+		return isIndexed(typ, f.Field)
+	case ContainsAny:
+		return isIndexed(typ, f.Field)
+	case ContainsAll:
+		return isIndexed(typ, f.Field)
+	case In:
+		return isIndexed(typ, f.Field)
+	case ranger:
+		return isIndexed(typ, f.indexRange().field)
+	case Match:
+		return isFulltext(typ, f.Field)
+	case Not:
+		return indexed(typ, f.Filter)
+	case And:
+		for _, child := range f {
+			if !indexed(typ, child) {
+				return false
+			}
+		}
+	case Or:
+		for _, child := range f {
+			if !indexed(typ, child) {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+/*
+superset returns a filter using only indexed fields that matches at least everything filter matches,
+or nil if it has to match all records.
+*/
+func superset(typ reflect.Type, filter QFilter) QFilter {
+	if indexed(typ, filter) {
+		return filter
+	}
+	switch f := filter.(type) {
+	case And:
+		var result And
+		for _, child := range f {
+			if childSuperset := superset(typ, child); childSuperset != nil {
+				result = append(result, childSuperset)
+			}
+		}
+		if len(result) > 0 {
+			return result
+		}
+	case Or:
+		var result Or
+		for _, child := range f {
+			childSuperset := superset(typ, child)
+			if childSuperset == nil {
+				return nil
+			}
+			result = append(result, childSuperset)
+		}
+		return result
+	}
+	return nil
+}
+
+/*
+Scan will allow this query to filter on fields without indices, by evaluating the filters on each record
+found using the filters that do have indices, at worst on all records of the type.
+
+Without Scan, filtering on fields without indices returns an error.
+*/
+func (self *Query) Scan() *Query {
+	self.scan = true
+	return self
+}
@@ -0,0 +1,190 @@
+package kol
+
+import (
+	"encoding/binary"
+	"reflect"
+	"time"
+
+	"github.com/zond/kcwraps/kc"
+	"github.com/zond/setop"
+)
+
+const (
+	softDeleted    = "sd"
+	deletedAtField = "DeletedAt"
+)
+
+// softDeletable returns whether typ has a time.Time DeletedAt field.
+func softDeletable(typ reflect.Type) bool {
+	field, found := typ.FieldByName(deletedAtField)
+	return found && field.Type == timeType
+}
+
+// deletedAt returns the DeletedAt field of value, if it is soft deleted.
+func deletedAt(value reflect.Value) (result time.Time, deleted bool) {
+	if !softDeletable(value.Type()) {
+		return
+	}
+	result = value.FieldByName(deletedAtField).Interface().(time.Time)
+	deleted = !result.IsZero()
+	return
+}
+
+// markDeleted adds id to the soft deleted records of typ if value is soft deleted.
+func (self *DB) markDeleted(id []byte, value reflect.Value, typ reflect.Type) (err error) {
+	if t, deleted := deletedAt(value); deleted {
+		return self.db.Set(kc.Keyify(softDeleted, typeName(typ), id), uint64Bytes(uint64(t.UnixNano())))
+	}
+	return
+}
+
+// unmarkDeleted removes id from the soft deleted records of typ if value is soft deleted.
+func (self *DB) unmarkDeleted(id []byte, value reflect.Value, typ reflect.Type) (err error) {
+	if _, deleted := deletedAt(value); deleted {
+		if err = self.db.Remove(kc.Keyify(softDeleted, typeName(typ), id)); err != nil && err.Error() == kc.NoRecord {
+			err = nil
+		}
+	}
+	return
+}
+
+/*
+setDeletedAt loads the stored object with id into value and obj, and sets its DeletedAt field to t, or returns NotFound
+if it doesn't exist or its DeletedAt field is already zero when t is zero, or non-zero when t is non-zero.
+
+The returned oldValue is a copy of the stored object.
+*/
+func (self *DB) setDeletedAt(id []byte, value reflect.Value, typ reflect.Type, obj interface{}, t time.Time) (oldValue reflect.Value, err error) {
+	oldValue = reflect.New(typ).Elem()
+	err = self.Transact(func(self *DB) (err error) {
+		if err = self.get(id, oldValue, oldValue.Addr().Interface()); err != nil {
+			return
+		}
+		if _, deleted := deletedAt(oldValue); deleted != t.IsZero() {
+			return NotFound
+		}
+		if err = self.get(id, value, obj); err != nil {
+			return
+		}
+		value.FieldByName(deletedAtField).Set(reflect.ValueOf(t))
+		if err = checkVersion(oldValue, value); err != nil {
+			return
+		}
+		if err = self.remember(id, typ, false); err != nil {
+			return
+		}
+		if err = self.deIndex(id, oldValue, typ); err != nil {
+			return
+		}
+		if err = self.index(id, value, typ); err != nil {
+			return
+		}
+		return self.save(id, typ, obj)
+	})
+	return
+}
+
+// softDel sets the DeletedAt field of the stored object with id, and emits it as deleted.
+func (self *DB) softDel(id []byte, value reflect.Value, typ reflect.Type, obj interface{}) (err error) {
+	var oldValue reflect.Value
+	if oldValue, err = self.setDeletedAt(id, value, typ, obj, time.Now()); err != nil {
+		return
+	}
+	return self.db.BetweenTransactions(func(d *kc.DB) (err error) {
+		return self.emit(typ, &oldValue, nil)
+	})
+}
+
+/*
+Undelete will restore the soft deleted object with the Id of obj by setting its DeletedAt field to zero,
+and load it into obj.
+
+Obj must be a pointer to a struct having a []byte Id field and a time.Time DeletedAt field.
+
+Returns NotFound if there is no soft deleted object with the Id of obj.
+*/
+func (self *DB) Undelete(obj interface{}) (err error) {
+	var value, id reflect.Value
+	if value, id, err = identify(obj); err != nil {
+		return
+	}
+	typ := value.Type()
+	if !softDeletable(typ) {
+		return NotFound
+	}
+	if _, err = self.setDeletedAt(id.Bytes(), value, typ, obj, time.Time{}); err != nil {
+		return
+	}
+	return self.db.BetweenTransactions(func(d *kc.DB) (err error) {
+		return self.emit(typ, nil, &value)
+	})
+}
+
+/*
+Purge will permanently remove the objects of the same type as obj that were soft deleted before the given time,
+and return the number of removed objects.
+
+Obj must be a pointer to a struct having a []byte Id field.
+*/
+func (self *DB) Purge(obj interface{}, before time.Time) (result int, err error) {
+	var value reflect.Value
+	if value, _, err = identify(obj); err != nil {
+		return
+	}
+	typ := value.Type()
+	keys := kc.Keyify(softDeleted, typeName(typ))
+	err = self.Transact(func(self *DB) (err error) {
+		for _, kv := range self.db.GetCollection(keys) {
+			if int64(binary.BigEndian.Uint64(kv.Value)) >= before.UnixNano() {
+				continue
+			}
+			id := kv.Keys[len(keys)]
+			old := reflect.New(typ)
+			if err = self.get(id, old.Elem(), old.Interface()); err != nil {
+				return
+			}
+			if err = self.remember(id, typ, true); err != nil {
+				return
+			}
+			if err = self.deIndex(id, old.Elem(), typ); err != nil {
+				return
+			}
+			if err = self.db.Remove(kc.Keyify(primaryKey, typeName(typ), id)); err != nil {
+				return
+			}
+			result++
+		}
+		return
+	})
+	return
+}
+
+// excludesDeleted returns whether this query has to exclude soft deleted records.
+func (self *Query) excludesDeleted() bool {
+	return !self.withDeleted && softDeletable(self.typ)
+}
+
+/*
+WithDeleted will make this query include soft deleted objects, i.e. objects with non-zero DeletedAt fields,
+which are otherwise excluded.
+*/
+func (self *Query) WithDeleted() *Query {
+	self.withDeleted = true
+	return self
+}
+
+// withoutDeleted returns op without the soft deleted records of the type of this query.
+func (self *Query) withoutDeleted(op *setop.SetOp) *setop.SetOp {
+	return &setop.SetOp{
+		Sources: []setop.SetOpSource{
+			setop.SetOpSource{
+				SetOp: op,
+			},
+			setop.SetOpSource{
+				Key: kc.JoinKeys(kc.Keyify(softDeleted, typeName(self.typ))),
+			},
+		},
+		Type:  setop.Difference,
+		Merge: setop.First,
+	}
+}
@@ -66,10 +66,10 @@ Subscribe will start the subscription.
 func (self *Subscription) Subscribe() {
 	self.db.subscriptionsMutex.Lock()
 	defer self.db.subscriptionsMutex.Unlock()
-	typeSubs, found := self.db.subscriptions[self.typ.Name()]
+	typeSubs, found := self.db.subscriptions[typeName(self.typ)]
 	if !found {
 		typeSubs = make(map[string]*Subscription)
-		self.db.subscriptions[self.typ.Name()] = typeSubs
+		self.db.subscriptions[typeName(self.typ)] = typeSubs
 	}
 	typeSubs[self.name] = self
 	return
@@ -164,7 +164,7 @@ func (self *DB) Subscription(name string, obj interface{}, ops Operation, subscr
 		name: name,
 		db:   self,
 		matcher: func(typ reflect.Type, value reflect.Value) (result bool, err error) {
-			if typ.Name() != wantedType.Name() {
+			if typeName(typ) != typeName(wantedType) {
 				return
 			}
 			if bytes.Compare(value.FieldByName(idField).Bytes(), wantedBytes) != 0 {
@@ -226,7 +226,7 @@ func (self *DB) emit(typ reflect.Type, oldValue, newValue *reflect.Value) (err e
 	}
 	self.subscriptionsMutex.RLock()
 	defer self.subscriptionsMutex.RUnlock()
-	for _, subscription := range self.subscriptions[typ.Name()] {
+	for _, subscription := range self.subscriptions[typeName(typ)] {
 		go subscription.handle(typ, oldValue, newValue)
 	}
 	return
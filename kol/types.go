@@ -0,0 +1,94 @@
+package kol
+
+import (
+	"fmt"
+	"reflect"
+	"sync"
+
+	"github.com/zond/kcwraps/kc"
+)
+
+/*
+KolTyper can be implemented by types that want to decide the name of their keyspaces,
+for example to stay in the same keyspace when moved to another package.
+*/
+type KolTyper interface {
+	KolType() string
+}
+
+var kolTyperType = reflect.TypeOf((*KolTyper)(nil)).Elem()
+
+var typeNamesMutex = new(sync.RWMutex)
+var typeNames = make(map[reflect.Type]string)
+
+/*
+RegisterType will make all records, indices and subscriptions of the type of obj use name as keyspace.
+
+Registering a type overrides any KolType method it has.
+*/
+func RegisterType(obj interface{}, name string) {
+	typ := reflect.TypeOf(obj)
+	for typ.Kind() == reflect.Ptr {
+		typ = typ.Elem()
+	}
+	typeNamesMutex.Lock()
+	defer typeNamesMutex.Unlock()
+	typeNames[typ] = name
+}
+
+/*
+typeName returns the name of the keyspace of typ.
+
+It is the registered name of typ, or the result of KolType if typ implements KolTyper,
+or the package path and name of typ.
+*/
+func typeName(typ reflect.Type) string {
+	typeNamesMutex.RLock()
+	name, found := typeNames[typ]
+	typeNamesMutex.RUnlock()
+	if found {
+		return name
+	}
+	if typ.Implements(kolTyperType) {
+		return reflect.Zero(typ).Interface().(KolTyper).KolType()
+	}
+	if reflect.PtrTo(typ).Implements(kolTyperType) {
+		return reflect.New(typ).Interface().(KolTyper).KolType()
+	}
+	if typ.Name() == "" {
+		return typ.String()
+	}
+	return fmt.Sprintf("%v.%v", typ.PkgPath(), typ.Name())
+}
+
+/*
+MigrateTypeName will move all records and indices of the type of obj from the keyspace
+named by the short type name (used by earlier versions of kol) to its current keyspace.
+
+Obj must be a pointer to a struct having a []byte Id field.
+*/
+func (self *DB) MigrateTypeName(obj interface{}) (err error) {
+	var value reflect.Value
+	if value, _, err = identify(obj); err != nil {
+		return
+	}
+	oldName := value.Type().Name()
+	newName := typeName(value.Type())
+	if oldName == newName {
+		return
+	}
+	return self.Transact(func(self *DB) (err error) {
+		for _, space := range []string{primaryKey, secondaryIndex, nilIndex, foreignIndex, compositeIndex, uniqueIndex, fulltextIndex, softDeleted, history, meta} {
+			for _, kv := range self.db.GetCollection(kc.Keyify(space, oldName)) {
+				kv.Keys[1] = []byte(newName)
+				if err = self.db.Set(kv.Keys, kv.Value); err != nil {
+					return
+				}
+			}
+			if err = self.db.ClearAll(kc.Keyify(space, oldName)); err != nil {
+				return
+			}
+		}
+		return
+	})
+}
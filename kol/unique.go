@@ -0,0 +1,216 @@
+package kol
+
+import (
+	"fmt"
+	"reflect"
+	"regexp"
+	"strings"
+
+	"github.com/zond/kcwraps/kc"
+)
+
+const (
+	unique      = "unique"
+	uniqueIndex = "ui"
+)
+
+var uniquePattern = regexp.MustCompile("unique<([^>]+)>")
+
+// ErrUniqueViolation is returned when saving a record would give it the same value for a unique field, or group of fields, as another record.
+type ErrUniqueViolation struct {
+	// Field is the name of the unique field, or the names of the unique fields joined by +.
+	Field string
+	// Id is the Id of the other record.
+	Id Id
+}
+
+func (self ErrUniqueViolation) Error() string {
+	return fmt.Sprintf("%v is not unique, it is the same as for %v", self.Field, self.Id)
+}
+
+/*
+uniques returns the unique constraints of typ.
+
+Fields tagged kol:"unique" are unique by themselves, and fields tagged kol:"unique<Field1+Field2>" declare
+that the combination of the named fields is unique.
+*/
+func uniques(typ reflect.Type) (result []composite) {
+	seen := make(map[string]bool)
+	for _, field := range taggedFields(typ) {
+		for _, param := range field.params {
+			var c composite
+			if param == unique {
+				c = composite{field.path}
+			} else if match := uniquePattern.FindStringSubmatch(param); match != nil {
+				c = composite(strings.Split(match[1], "+"))
+			}
+			if c != nil && !seen[c.name()] {
+				result = append(result, c)
+				seen[c.name()] = true
+			}
+		}
+	}
+	return
+}
+
+func uniqueKey(value reflect.Value, typ reflect.Type, c composite) (keys [][]byte, err error) {
+	keys = [][]byte{
+		[]byte(uniqueIndex),
+		[]byte(typeName(typ)),
+		[]byte(c.name()),
+	}
+	for _, fieldName := range c {
+		var field reflect.Value
+		if field, err = fieldByPath(value, fieldName); err != nil {
+			err = fmt.Errorf("%v has a unique constraint %v, but there is no field named %v", typeName(typ), c.name(), fieldName)
+			return
+		}
+		if !field.IsValid() {
+			// Inside a nil struct pointer, so not constrained
+			keys = nil
+			return
+		}
+		var valuePart []byte
+		if valuePart, err = indexBytes(field.Type(), field); err != nil {
+			return
+		}
+		keys = append(keys, valuePart)
+	}
+	return
+}
+
+// unique claims the unique values of value for id, or returns an ErrUniqueViolation if another record already has them.
+func (self *DB) unique(id []byte, value reflect.Value, typ reflect.Type) (err error) {
+	for _, c := range uniques(typ) {
+		var keys [][]byte
+		if keys, err = uniqueKey(value, typ, c); err != nil {
+			return
+		}
+		if keys == nil {
+			continue
+		}
+		var existing []byte
+		if existing, err = self.db.Get(keys); err == nil {
+			if string(existing) != string(id) {
+				err = ErrUniqueViolation{
+					Field: c.name(),
+					Id:    Id(existing),
+				}
+				return
+			}
+		} else if err.Error() != kc.NoRecord {
+			return
+		}
+		if err = self.db.Set(keys, id); err != nil {
+			return
+		}
+	}
+	return
+}
+
+// deUnique releases the unique values of value.
+func (self *DB) deUnique(value reflect.Value, typ reflect.Type) (err error) {
+	for _, c := range uniques(typ) {
+		var keys [][]byte
+		if keys, err = uniqueKey(value, typ, c); err != nil {
+			return
+		}
+		if keys == nil {
+			continue
+		}
+		if err = self.db.Remove(keys); err != nil && err.Error() != kc.NoRecord {
+			return
+		}
+		err = nil
+	}
+	return
+}
+
+// reUnique releases the unique values of oldValue not in newValue, and claims those of newValue not in oldValue.
+func (self *DB) reUnique(id []byte, oldValue, newValue reflect.Value, typ reflect.Type) (err error) {
+	for _, c := range uniques(typ) {
+		var oldKeys, newKeys [][]byte
+		if oldKeys, err = uniqueKey(oldValue, typ, c); err != nil {
+			return
+		}
+		if newKeys, err = uniqueKey(newValue, typ, c); err != nil {
+			return
+		}
+		if oldKeys != nil && newKeys != nil && string(kc.JoinKeys(oldKeys)) == string(kc.JoinKeys(newKeys)) {
+			continue
+		}
+		if oldKeys != nil {
+			if err = self.db.Remove(oldKeys); err != nil && err.Error() != kc.NoRecord {
+				return
+			}
+			err = nil
+		}
+		if newKeys != nil {
+			var existing []byte
+			if existing, err = self.db.Get(newKeys); err == nil {
+				if string(existing) != string(id) {
+					err = ErrUniqueViolation{
+						Field: c.name(),
+						Id:    Id(existing),
+					}
+					return
+				}
+			} else if err.Error() != kc.NoRecord {
+				return
+			}
+			if err = self.db.Set(newKeys, id); err != nil {
+				return
+			}
+		}
+	}
+	return
+}
+
+/*
+GetUnique will find the record having values for the unique field, or group of fields, named field, and decode it into obj.
+
+Field is either the name of a field tagged kol:"unique" or the fields of a kol:"unique<Field1+Field2>" tag joined by +,
+and values must contain one value for each named field.
+
+Obj must be a pointer to a struct having a []byte Id field.
+*/
+func (self *DB) GetUnique(obj interface{}, field string, values ...interface{}) (err error) {
+	var value reflect.Value
+	if value, _, err = identify(obj); err != nil {
+		return
+	}
+	typ := value.Type()
+	fields := strings.Split(field, "+")
+	if len(fields) != len(values) {
+		err = fmt.Errorf("%v needs %v values, got %v", field, len(fields), len(values))
+		return
+	}
+	found := false
+	for _, c := range uniques(typ) {
+		found = found || c.name() == field
+	}
+	if !found {
+		err = fmt.Errorf("%v does not have a unique constraint %v", typeName(typ), field)
+		return
+	}
+	keys := [][]byte{
+		[]byte(uniqueIndex),
+		[]byte(typeName(typ)),
+		[]byte(field),
+	}
+	for index, fieldName := range fields {
+		var b []byte
+		if b, err = filterBytes(typ, fieldName, values[index]); err != nil {
+			return
+		}
+		keys = append(keys, b)
+	}
+	var id []byte
+	if id, err = self.db.Get(keys); err != nil {
+		if err.Error() == kc.NoRecord {
+			err = NotFound
+		}
+		return
+	}
+	return self.get(id, value, obj)
+}
@@ -0,0 +1,69 @@
+package kol
+
+import (
+	"fmt"
+	"reflect"
+)
+
+const (
+	versionField = "Version"
+)
+
+// ErrConflict is returned by Set when the Version of the saved object is not the Version of the stored object.
+type ErrConflict struct {
+	// Current is a pointer to the stored object, or nil if it doesn't exist any more.
+	Current interface{}
+}
+
+func (self ErrConflict) Error() string {
+	if self.Current == nil {
+		return "Version conflict, the object doesn't exist any more"
+	}
+	return fmt.Sprintf("Version conflict, the stored object is %+v", self.Current)
+}
+
+// versionOf returns the Version field of value, if it has an integer one.
+func versionOf(value reflect.Value) (result reflect.Value, found bool) {
+	result = value.FieldByName(versionField)
+	switch result.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64, reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		found = true
+	}
+	return
+}
+
+func getVersion(version reflect.Value) uint64 {
+	switch version.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return uint64(version.Int())
+	}
+	return version.Uint()
+}
+
+func setVersion(version reflect.Value, v uint64) {
+	switch version.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		version.SetInt(int64(v))
+	default:
+		version.SetUint(v)
+	}
+}
+
+/*
+checkVersion returns an ErrConflict unless value has the same Version as the stored oldValue, which must be
+addressable, and then increments the Version of value.
+*/
+func checkVersion(oldValue, value reflect.Value) (err error) {
+	version, found := versionOf(value)
+	if !found {
+		return
+	}
+	oldVersion, _ := versionOf(oldValue)
+	if getVersion(version) != getVersion(oldVersion) {
+		return ErrConflict{
+			Current: oldValue.Addr().Interface(),
+		}
+	}
+	setVersion(version, getVersion(version)+1)
+	return
+}